@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PackumentMeta sits next to every cached packument and carries what is
+// needed to revalidate it with the registry.
+type PackumentMeta struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	Integrity    string    `json:"integrity"`
+	Fetched      time.Time `json:"fetched"`
+}
+
+type NotCachedError struct {
+	What string
+}
+
+func (e *NotCachedError) Error() string {
+	return fmt.Sprintf("%s is not in the offline cache", e.What)
+}
+
+func isOffline() bool {
+	return hasFlag("offline")
+}
+
+func isPreferOffline() bool {
+	return hasFlag("prefer-offline")
+}
+
+func getCacheDir() (string, error) {
+	if customRoot := os.Getenv("GOPM_ROOT"); customRoot != "" {
+		return filepath.Join(customRoot, "cache"), nil
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "gopm", "cache"), nil
+}
+
+func packumentCachePath(name string) (string, error) {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "packuments", url.PathEscape(name)+".json"), nil
+}
+
+func tarballCachePath(integrity string) (string, error) {
+	verifier, err := newIntegrityVerifier(integrity)
+	if err != nil {
+		return "", err
+	}
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(verifier.expected)
+	return filepath.Join(cacheDir, "tarballs", verifier.algorithm, digest[:2], digest[2:]+".tgz"), nil
+}
+
+func readPackumentCache(path string) ([]byte, *PackumentMeta) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil
+	}
+	metaData, err := os.ReadFile(path + ".meta")
+	if err != nil {
+		return nil, nil
+	}
+	var meta PackumentMeta
+	if err := json.Unmarshal(metaData, &meta); err != nil {
+		return nil, nil
+	}
+	return data, &meta
+}
+
+func writePackumentCache(path string, data []byte, meta *PackumentMeta) error {
+	meta.Integrity = computeIntegrity(data)
+	metaData, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, data); err != nil {
+		return err
+	}
+	return writeFileAtomic(path+".meta", metaData)
+}
+
+// fetchPackument returns the raw packument for name, going through the disk
+// cache according to --offline / --prefer-offline and revalidating cached
+// copies with the registry's ETag and Last-Modified headers otherwise.
+func fetchPackument(name, packumentURL string) ([]byte, error) {
+	cachePath, err := packumentCachePath(name)
+	if err != nil {
+		return nil, err
+	}
+	cached, meta := readPackumentCache(cachePath)
+	if cached != nil && (isOffline() || isPreferOffline()) {
+		return cached, nil
+	}
+	if isOffline() {
+		return nil, &NotCachedError{What: name}
+	}
+	req, err := newRegistryRequest(packumentURL)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if cached != nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+	resp, err := registryDo(req)
+	if err != nil {
+		if cached != nil {
+			cacheWarning(fmt.Sprintf("using cached metadata for %s: %v", name, err))
+			return cached, nil
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		meta.Fetched = time.Now()
+		writePackumentCache(cachePath, cached, meta)
+		return cached, nil
+	}
+	if err := checkRegistryResponse(resp, name); err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := writePackumentCache(cachePath, data, &PackumentMeta{
+		URL:          packumentURL,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+		Fetched:      time.Now(),
+	}); err != nil {
+		cacheWarning(fmt.Sprintf("failed to cache metadata for %s: %v", name, err))
+	}
+	return data, nil
+}
+
+// cacheWarning reports a cache problem on stderr when --json output owns
+// stdout, and as a normal warning otherwise.
+func cacheWarning(msg string) {
+	if hasFlag("json") {
+		fmt.Fprintln(os.Stderr, msg)
+		return
+	}
+	ui.Warning(msg)
+}
+
+// cachingReader tees a tarball download into a temporary file that is only
+// moved into the cache once the caller has verified the contents.
+type cachingReader struct {
+	body io.ReadCloser
+	tmp  *os.File
+	dest string
+}
+
+func (c *cachingReader) Read(p []byte) (int, error) {
+	n, err := c.body.Read(p)
+	if n > 0 && c.tmp != nil {
+		if _, werr := c.tmp.Write(p[:n]); werr != nil {
+			c.tmp.Close()
+			os.Remove(c.tmp.Name())
+			c.tmp = nil
+		}
+	}
+	return n, err
+}
+
+func (c *cachingReader) Commit() {
+	if c.tmp == nil {
+		return
+	}
+	c.tmp.Close()
+	if err := os.Rename(c.tmp.Name(), c.dest); err != nil {
+		os.Remove(c.tmp.Name())
+	}
+	c.tmp = nil
+}
+
+func (c *cachingReader) Close() error {
+	if c.tmp != nil {
+		c.tmp.Close()
+		os.Remove(c.tmp.Name())
+	}
+	return c.body.Close()
+}
+
+// cachedTarball is a tarball served from the cache. It is evicted when it
+// fails to extract or verify, so later installs fetch it again.
+type cachedTarball struct {
+	*os.File
+}
+
+func (c *cachedTarball) evict() {
+	c.Close()
+	os.Remove(c.Name())
+}
+
+// openTarball returns the tarball body, its download size (zero when served
+// from cache) and a commit func to call once the contents have been verified.
+func openTarball(tarballURL, integrity string) (io.ReadCloser, int64, func(), error) {
+	cachePath := ""
+	if integrity != "" {
+		if path, err := tarballCachePath(integrity); err == nil {
+			cachePath = path
+		}
+	}
+	if cachePath != "" {
+		if f, err := os.Open(cachePath); err == nil {
+			return &cachedTarball{f}, 0, func() {}, nil
+		}
+	}
+	if isOffline() {
+		return nil, 0, nil, &NotCachedError{What: tarballURL}
+	}
+	req, err := newRegistryRequest(tarballURL)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	resp, err := registryDo(req)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if err := checkRegistryResponse(resp, tarballURL); err != nil {
+		resp.Body.Close()
+		return nil, 0, nil, err
+	}
+	reader := &cachingReader{body: newResumableBody(req, resp), dest: cachePath}
+	if cachePath != "" && os.MkdirAll(filepath.Dir(cachePath), 0755) == nil {
+		if tmp, err := os.CreateTemp(filepath.Dir(cachePath), ".gopm-"); err == nil {
+			reader.tmp = tmp
+		}
+	}
+	return reader, resp.ContentLength, reader.Commit, nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".gopm-")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type storeEntry struct {
+	dir   string
+	index *StoreIndex
+}
+
+func cacheCommand(args []string) {
+	if len(args) == 0 {
+		ui.Error("usage: gopm cache <ls|verify|clean|add> [package]")
+		exitCode = 1
+		return
+	}
+	switch args[0] {
+	case "ls", "list":
+		cacheList()
+	case "verify":
+		cacheVerify()
+	case "clean", "clear":
+		name := ""
+		if len(args) > 1 {
+			name = args[1]
+		}
+		cacheClean(name)
+	case "add":
+		if len(args) < 2 {
+			ui.Error("usage: gopm cache add <package>[@range]")
+			exitCode = 1
+			return
+		}
+		for _, spec := range args[1:] {
+			cacheAdd(spec)
+		}
+	default:
+		ui.Error(fmt.Sprintf("unknown cache command: %s", args[0]))
+		exitCode = 1
+	}
+}
+
+// splitPackageSpec splits name@range, keeping the leading @ of scoped names.
+func splitPackageSpec(arg string) (string, string) {
+	if idx := strings.LastIndex(arg, "@"); idx > 0 {
+		return arg[:idx], arg[idx+1:]
+	}
+	return arg, "latest"
+}
+
+func listPackumentCache() ([]string, error) {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(filepath.Join(cacheDir, "packuments"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".json") {
+			paths = append(paths, filepath.Join(cacheDir, "packuments", entry.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+func listTarballCache() ([]string, error) {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	err = filepath.WalkDir(filepath.Join(cacheDir, "tarballs"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(path, ".tgz") {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	return paths, err
+}
+
+func listStore() ([]storeEntry, error) {
+	storeDir, err := getStoreDir()
+	if err != nil {
+		return nil, err
+	}
+	var entries []storeEntry
+	err = filepath.WalkDir(storeDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || d.Name() != STORE_INDEX_FILE {
+			return nil
+		}
+		entry := storeEntry{dir: filepath.Dir(path)}
+		if data, err := os.ReadFile(path); err == nil {
+			var index StoreIndex
+			if json.Unmarshal(data, &index) == nil {
+				entry.index = &index
+			}
+		}
+		entries = append(entries, entry)
+		return filepath.SkipDir
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].label() < entries[j].label()
+	})
+	return entries, err
+}
+
+func (e storeEntry) label() string {
+	if e.index == nil {
+		return filepath.Base(e.dir)
+	}
+	return fmt.Sprintf("%s@%s", e.index.Name, e.index.Version)
+}
+
+func dirSize(dir string) int64 {
+	var size int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+func fileSize(path string) int64 {
+	if info, err := os.Stat(path); err == nil {
+		return info.Size()
+	}
+	return 0
+}
+
+func cacheList() {
+	packuments, err := listPackumentCache()
+	if err != nil {
+		ui.Error(fmt.Sprintf("failed to read cache: %v", err))
+		exitCode = 1
+		return
+	}
+	tarballs, _ := listTarballCache()
+	store, _ := listStore()
+	cacheDir, _ := getCacheDir()
+	storeDir, _ := getStoreDir()
+	ui.Header(fmt.Sprintf("metadata cache (%d packages)", len(packuments)))
+	var metaSize int64
+	for _, path := range packuments {
+		name, _ := url.PathUnescape(strings.TrimSuffix(filepath.Base(path), ".json"))
+		size := fileSize(path)
+		metaSize += size
+		fetched := ""
+		if _, meta := readPackumentCache(path); meta != nil {
+			fetched = meta.Fetched.Format(time.RFC1123)
+		}
+		fmt.Printf("  • %s  %s  %s\n", name, formatBytes(size), fetched)
+	}
+	ui.Header(fmt.Sprintf("package store (%d packages)", len(store)))
+	var storeSize int64
+	for _, entry := range store {
+		size := dirSize(entry.dir)
+		storeSize += size
+		fmt.Printf("  • %s  %s\n", entry.label(), formatBytes(size))
+	}
+	var tarballSize int64
+	for _, path := range tarballs {
+		tarballSize += fileSize(path)
+	}
+	ui.Header("cache summary")
+	ui.Info(fmt.Sprintf(" cache: %s", cacheDir))
+	ui.Info(fmt.Sprintf(" store: %s", storeDir))
+	ui.Info(fmt.Sprintf(" metadata: %d entries, %s", len(packuments), formatBytes(metaSize)))
+	ui.Info(fmt.Sprintf(" tarballs: %d entries, %s", len(tarballs), formatBytes(tarballSize)))
+	ui.Info(fmt.Sprintf(" store: %d packages, %s", len(store), formatBytes(storeSize)))
+}
+
+func cacheVerify() {
+	ui.Header("verifying cache")
+	startTime := time.Now()
+	checked, evicted := 0, 0
+	evict := func(path, what string, reason error) {
+		ui.Warning(fmt.Sprintf("evicting %s: %v", what, reason))
+		os.RemoveAll(path)
+		evicted++
+	}
+	packuments, err := listPackumentCache()
+	if err != nil {
+		ui.Error(fmt.Sprintf("failed to read cache: %v", err))
+		exitCode = 1
+		return
+	}
+	for _, path := range packuments {
+		checked++
+		data, meta := readPackumentCache(path)
+		if data == nil {
+			evict(path, filepath.Base(path), fmt.Errorf("missing or unreadable metadata"))
+			os.Remove(path + ".meta")
+			continue
+		}
+		if actual := computeIntegrity(data); actual != meta.Integrity {
+			evict(path, meta.URL, &IntegrityError{Package: filepath.Base(path), Expected: meta.Integrity, Actual: actual})
+			os.Remove(path + ".meta")
+		}
+	}
+	tarballs, _ := listTarballCache()
+	for _, path := range tarballs {
+		checked++
+		algorithm := filepath.Base(filepath.Dir(filepath.Dir(path)))
+		digest := filepath.Base(filepath.Dir(path)) + strings.TrimSuffix(filepath.Base(path), ".tgz")
+		if err := verifyCachedTarball(path, algorithm, digest); err != nil {
+			evict(path, filepath.Base(path), err)
+		}
+	}
+	store, _ := listStore()
+	for _, entry := range store {
+		checked++
+		if err := verifyStoreEntry(entry); err != nil {
+			evict(entry.dir, entry.label(), err)
+		}
+	}
+	ui.Header("verification summary")
+	ui.Info(fmt.Sprintf("✓ %d entries checked, ✗ %d evicted", checked, evicted))
+	ui.Info(fmt.Sprintf(" total time: %v", time.Since(startTime)))
+}
+
+func verifyCachedTarball(path, algorithm, digest string) error {
+	raw, err := hex.DecodeString(digest)
+	if err != nil {
+		return fmt.Errorf("unrecognised cache key")
+	}
+	verifier, err := newIntegrityVerifier(algorithm + "-" + base64.StdEncoding.EncodeToString(raw))
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(verifier, f); err != nil {
+		return err
+	}
+	return verifier.Verify(filepath.Base(path))
+}
+
+func verifyStoreEntry(entry storeEntry) error {
+	if entry.index == nil {
+		return fmt.Errorf("unreadable %s", STORE_INDEX_FILE)
+	}
+	for rel, expected := range entry.index.Files {
+		actual, err := hashFile(filepath.Join(entry.dir, filepath.FromSlash(rel)))
+		if err != nil {
+			return err
+		}
+		if actual != expected {
+			return &IntegrityError{Package: entry.label() + "/" + rel, Expected: expected, Actual: actual}
+		}
+	}
+	return nil
+}
+
+func cacheClean(name string) {
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		ui.Error(fmt.Sprintf("failed to determine cache directory: %v", err))
+		exitCode = 1
+		return
+	}
+	storeDir, err := getStoreDir()
+	if err != nil {
+		ui.Error(fmt.Sprintf("failed to determine store directory: %v", err))
+		exitCode = 1
+		return
+	}
+	if name == "" {
+		ui.Header("cleaning cache")
+		size := dirSize(cacheDir) + dirSize(storeDir)
+		if err := os.RemoveAll(cacheDir); err != nil {
+			ui.Error(fmt.Sprintf("failed to remove %s: %v", cacheDir, err))
+			exitCode = 1
+			return
+		}
+		if err := os.RemoveAll(storeDir); err != nil {
+			ui.Error(fmt.Sprintf("failed to remove %s: %v", storeDir, err))
+			exitCode = 1
+			return
+		}
+		ui.Success(fmt.Sprintf("removed %s from the cache", formatBytes(size)))
+		return
+	}
+	ui.Header(fmt.Sprintf("cleaning %s from cache", name))
+	var freed int64
+	removed := 0
+	integrities := make(map[string]bool)
+	if packumentPath, err := packumentCachePath(name); err == nil {
+		if data, _ := readPackumentCache(packumentPath); data != nil {
+			var registryData RegistryResponse
+			if json.Unmarshal(data, &registryData) == nil {
+				for _, pkg := range registryData.Versions {
+					if locked := lockedFromManifest(pkg); locked.Integrity != "" {
+						integrities[locked.Integrity] = true
+					}
+				}
+			}
+			freed += fileSize(packumentPath)
+			os.Remove(packumentPath)
+			os.Remove(packumentPath + ".meta")
+			removed++
+		}
+	}
+	store, _ := listStore()
+	for _, entry := range store {
+		if entry.index == nil || entry.index.Name != name {
+			continue
+		}
+		integrities[entry.index.Integrity] = true
+		freed += dirSize(entry.dir)
+		os.RemoveAll(entry.dir)
+		removed++
+	}
+	for integrity := range integrities {
+		if path, err := tarballCachePath(integrity); err == nil {
+			if size := fileSize(path); size > 0 {
+				freed += size
+				os.Remove(path)
+				removed++
+			}
+		}
+	}
+	if removed == 0 {
+		ui.Warning(fmt.Sprintf("%s is not in the cache", name))
+		return
+	}
+	ui.Success(fmt.Sprintf("removed %d entries (%s) for %s", removed, formatBytes(freed), name))
+}
+
+// cacheAdd resolves spec and its whole dependency tree and stores every
+// package, so a later --offline install of it needs no network.
+func cacheAdd(arg string) {
+	startTime := time.Now()
+	name, spec := splitPackageSpec(arg)
+	ui.Header(fmt.Sprintf("adding %s@%s to cache", name, spec))
+	r := newResolver("", &LockedPackage{Dependencies: map[string]string{name: spec}}, nil, nil)
+	r.resolve()
+	results := r.failures
+	r.tree.walk(func(node *depNode) {
+		result := InstallResult{
+			Task:     InstallTask{Name: node.name, Version: node.pkg.Version, Locked: node.pkg},
+			Resolved: node.pkg,
+		}
+		taskStart := time.Now()
+		if node.pkg.Integrity == "" {
+			result.Error = fmt.Errorf("no integrity published, cannot be cached")
+		} else if entryDir, err := storeEntryDir(node.pkg.Integrity); err != nil {
+			result.Error = err
+		} else {
+			result.Size, result.Error = addToStore(node.pkg, entryDir, node.name)
+		}
+		result.Duration = time.Since(taskStart)
+		results = append(results, result)
+	})
+	displayInstallResults(results, startTime)
+}
@@ -0,0 +1,89 @@
+package main
+
+import "strings"
+
+var (
+	cliFlags = make(map[string][]string)
+	// valueFlags take the following argument as their value when it is not
+	// given with "=", e.g. --workspace app.
+	valueFlags = map[string]bool{
+		"workspace": true,
+		"omit":      true,
+		"include":   true,
+		"os":        true,
+		"cpu":       true,
+		"libc":      true,
+	}
+	// shortFlags maps single-letter options to their long names. Others, like
+	// -g, stay positional.
+	shortFlags = map[string]string{
+		"w": "workspace",
+		"D": "save-dev",
+		"O": "save-optional",
+		"E": "save-exact",
+		"i": "interactive",
+	}
+)
+
+// parseFlags pulls --name and --name=value options out of args and returns
+// the remaining positional arguments; --no-name is recorded as name=false.
+// Everything from a bare "--" onwards is left untouched so it can be passed
+// through to scripts, as is everything after the package given to exec.
+func parseFlags(args []string) []string {
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" || (len(positional) == 2 && (positional[0] == "exec" || positional[0] == "x")) {
+			positional = append(positional, args[i:]...)
+			break
+		}
+		var name, value string
+		var ok bool
+		switch {
+		case strings.HasPrefix(arg, "--") && len(arg) > 2:
+			name, value, ok = strings.Cut(arg[2:], "=")
+		case len(arg) == 2 && arg[0] == '-' && shortFlags[arg[1:]] != "":
+			name = shortFlags[arg[1:]]
+		default:
+			positional = append(positional, arg)
+			continue
+		}
+		if !ok && strings.HasPrefix(name, "no-") {
+			name, value, ok = name[3:], "false", true
+		}
+		if !ok {
+			value = "true"
+			if valueFlags[name] && i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				value = args[i+1]
+				i++
+			}
+		}
+		cliFlags[name] = append(cliFlags[name], value)
+	}
+	return positional
+}
+
+func hasFlag(name string) bool {
+	values, ok := cliFlags[name]
+	return ok && values[len(values)-1] != "false"
+}
+
+// flagValues returns every value given for a repeatable flag.
+func flagValues(name string) []string {
+	return cliFlags[name]
+}
+
+// boolOption reads a boolean setting from the command line, then .npmrc and
+// the environment, and otherwise returns def.
+func boolOption(name string, def bool) bool {
+	if values, ok := cliFlags[name]; ok {
+		return values[len(values)-1] != "false"
+	}
+	switch getConfig().Get(name) {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return def
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// NpmConfig holds settings merged from .npmrc files and the environment, in
+// npm's precedence order: environment, project, user, then global.
+type NpmConfig struct {
+	values map[string]string
+}
+
+var (
+	npmConfig     *NpmConfig
+	npmConfigOnce sync.Once
+	configEnvRe   = regexp.MustCompile(`\$\{[^}]+\}`)
+)
+
+func getConfig() *NpmConfig {
+	npmConfigOnce.Do(func() {
+		npmConfig = loadNpmConfig()
+	})
+	return npmConfig
+}
+
+func loadNpmConfig() *NpmConfig {
+	c := &NpmConfig{values: make(map[string]string)}
+	for _, path := range npmrcPaths() {
+		c.loadFile(path)
+	}
+	c.loadEnv()
+	return c
+}
+
+// npmrcPaths lists config files from lowest to highest precedence.
+func npmrcPaths() []string {
+	var paths []string
+	if globalConfig := os.Getenv("NPM_CONFIG_GLOBALCONFIG"); globalConfig != "" {
+		paths = append(paths, globalConfig)
+	} else if prefix, err := getGlobalPrefix(); err == nil {
+		paths = append(paths, filepath.Join(prefix, "etc", "npmrc"))
+	}
+	if userConfig := os.Getenv("NPM_CONFIG_USERCONFIG"); userConfig != "" {
+		paths = append(paths, userConfig)
+	} else if homeDir, err := os.UserHomeDir(); err == nil {
+		paths = append(paths, filepath.Join(homeDir, ".npmrc"))
+	}
+	if cwd, err := os.Getwd(); err == nil {
+		paths = append(paths, filepath.Join(cwd, ".npmrc"))
+	}
+	return paths
+}
+
+func getGlobalPrefix() (string, error) {
+	globalDir, err := getGlobalInstallDir()
+	if err != nil {
+		return "", err
+	}
+	if filepath.Base(filepath.Dir(globalDir)) == "lib" {
+		return filepath.Dir(filepath.Dir(globalDir)), nil
+	}
+	return filepath.Dir(globalDir), nil
+}
+
+func (c *NpmConfig) loadFile(path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	lists := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") || strings.HasPrefix(line, "[") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		key = expandConfigEnv(strings.TrimSpace(key))
+		value = expandConfigEnv(unquoteConfigValue(strings.TrimSpace(value)))
+		if strings.HasSuffix(key, "[]") {
+			// list entries such as ca[]=... accumulate, one per line
+			key = strings.TrimSuffix(key, "[]")
+			if previous, ok := lists[key]; ok {
+				value = previous + "\n" + value
+			}
+			lists[key] = value
+		}
+		c.values[key] = value
+	}
+}
+
+// expandConfigEnv replaces ${VAR} references the way npm does, so tokens can
+// be kept out of committed .npmrc files.
+func expandConfigEnv(value string) string {
+	return configEnvRe.ReplaceAllStringFunc(value, func(ref string) string {
+		return os.Getenv(ref[2 : len(ref)-1])
+	})
+}
+
+func unquoteConfigValue(value string) string {
+	if len(value) >= 2 {
+		if (value[0] == '"' && value[len(value)-1] == '"') || (value[0] == '\'' && value[len(value)-1] == '\'') {
+			return value[1 : len(value)-1]
+		}
+	}
+	return value
+}
+
+func (c *NpmConfig) loadEnv() {
+	for _, env := range os.Environ() {
+		key, value, ok := strings.Cut(env, "=")
+		if !ok || !strings.HasPrefix(strings.ToLower(key), "npm_config_") {
+			continue
+		}
+		name := strings.ReplaceAll(strings.ToLower(key[len("npm_config_"):]), "_", "-")
+		if name == "globalconfig" || name == "userconfig" {
+			continue
+		}
+		c.values[name] = value
+	}
+	if registry := os.Getenv("GOPM_REGISTRY"); registry != "" {
+		c.values["registry"] = registry
+	}
+}
+
+func (c *NpmConfig) Get(key string) string {
+	return c.values[key]
+}
+
+// registryFor returns the registry a package is fetched from, honouring
+// @scope:registry entries before the default registry.
+func (c *NpmConfig) registryFor(name string) string {
+	if strings.HasPrefix(name, "@") {
+		scope, _, _ := strings.Cut(name, "/")
+		if registry := c.Get(scope + ":registry"); registry != "" {
+			return strings.TrimSuffix(registry, "/")
+		}
+	}
+	if registry := c.Get("registry"); registry != "" {
+		return strings.TrimSuffix(registry, "/")
+	}
+	return NPM_REGISTRY_URL
+}
+
+func packumentURL(name string) string {
+	escaped := name
+	if strings.HasPrefix(name, "@") {
+		escaped = strings.Replace(name, "/", "%2f", 1)
+	}
+	return getConfig().registryFor(name) + "/" + escaped
+}
+
+// tarballURL points tarballs the public registry advertises at the configured
+// registry instead, the way npm's replace-registry-host default does.
+func tarballURL(name, resolved string) string {
+	registry := getConfig().registryFor(name)
+	if registry == NPM_REGISTRY_URL || !strings.HasPrefix(resolved, NPM_REGISTRY_URL+"/") {
+		return resolved
+	}
+	return registry + strings.TrimPrefix(resolved, NPM_REGISTRY_URL)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Engines is the package.json "engines" field. Some very old packages
+// published it as an array, which is ignored rather than failing the whole
+// packument.
+type Engines map[string]string
+
+func (e *Engines) UnmarshalJSON(data []byte) error {
+	var engines map[string]string
+	if err := json.Unmarshal(data, &engines); err == nil {
+		*e = engines
+	}
+	return nil
+}
+
+var (
+	nodeVersion     string
+	nodeVersionOnce sync.Once
+)
+
+// currentNodeVersion is the node-version config, or else what node --version
+// on PATH reports, without the leading v. It is empty when there is no node.
+func currentNodeVersion() string {
+	nodeVersionOnce.Do(func() {
+		nodeVersion = getConfig().Get("node-version")
+		if nodeVersion == "" {
+			if nodePath, err := exec.LookPath("node"); err == nil {
+				if out, err := exec.Command(nodePath, "--version").Output(); err == nil {
+					nodeVersion = strings.TrimSpace(string(out))
+				}
+			}
+		}
+		nodeVersion = strings.TrimPrefix(nodeVersion, "v")
+	})
+	return nodeVersion
+}
+
+// engineVersions are the engines gopm can check, with the version of each.
+func engineVersions() map[string]string {
+	return map[string]string{
+		"node": currentNodeVersion(),
+		"gopm": GOPM_VERSION,
+	}
+}
+
+// engineProblems describes each engine pkg requires a version of that is not
+// the one in use.
+func engineProblems(name string, pkg *LockedPackage) []string {
+	var problems []string
+	for engine, current := range engineVersions() {
+		wanted, ok := pkg.Engines[engine]
+		if !ok || current == "" {
+			continue
+		}
+		if _, err := parseRange(wanted); err != nil {
+			continue
+		}
+		if !satisfiesRange(current, wanted) {
+			label := name
+			if pkg.Version != "" {
+				label += "@" + pkg.Version
+			}
+			problems = append(problems, fmt.Sprintf("%s requires %s %s (current: %s)", label, engine, wanted, current))
+		}
+	}
+	return problems
+}
+
+// checkEngines compares the engines of the project and of every package
+// about to be installed with the node and gopm versions in use. Mismatches
+// are warnings, or an error under engine-strict.
+func checkEngines(root *LockedPackage, tasks []InstallTask) error {
+	rootName := root.Name
+	if rootName == "" {
+		rootName = "the root project"
+	}
+	problems := engineProblems(rootName, root)
+	for _, task := range tasks {
+		if task.Locked != nil {
+			problems = append(problems, engineProblems(task.Name, task.Locked)...)
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	strict := boolOption("engine-strict", false)
+	if strict {
+		ui.Error("unsupported engines:")
+	} else {
+		ui.Warning("unsupported engines:")
+	}
+	for _, problem := range problems {
+		fmt.Printf("  • %s\n", problem)
+	}
+	if strict {
+		return fmt.Errorf("not installing: engine-strict is set and %d engine requirements are not met", len(problems))
+	}
+	return nil
+}
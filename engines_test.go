@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// withFakeNode puts a node on PATH that reports version, and resets the
+// cached node version and config so currentNodeVersion asks it again.
+func withFakeNode(t *testing.T, version string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake node is a shell script")
+	}
+	binDir := t.TempDir()
+	script := "#!/bin/sh\necho " + version + "\n"
+	if err := os.WriteFile(filepath.Join(binDir, "node"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	savedFlags, savedUI := cliFlags, ui
+	npmConfigOnce.Do(func() {})
+	npmConfig = &NpmConfig{values: make(map[string]string)}
+	cliFlags = make(map[string][]string)
+	nodeVersionOnce = sync.Once{}
+	ui = NewUI()
+	t.Cleanup(func() {
+		// the next getConfig loads the real config again
+		npmConfig, npmConfigOnce = nil, sync.Once{}
+		cliFlags, ui = savedFlags, savedUI
+		nodeVersionOnce = sync.Once{}
+	})
+}
+
+func TestCheckEnginesWithFakeNode(t *testing.T) {
+	withFakeNode(t, "v14.0.0")
+	if got := currentNodeVersion(); got != "14.0.0" {
+		t.Fatalf("currentNodeVersion() = %q, want 14.0.0", got)
+	}
+	root := &LockedPackage{Name: "app"}
+	tasks := []InstallTask{{
+		Name:   "modern",
+		Locked: &LockedPackage{Version: "1.0.0", Engines: Engines{"node": ">=16"}},
+	}}
+
+	problems := engineProblems("modern", tasks[0].Locked)
+	if len(problems) != 1 || !strings.Contains(problems[0], "node >=16 (current: 14.0.0)") {
+		t.Fatalf("engineProblems = %q, want one node >=16 problem", problems)
+	}
+	if err := checkEngines(root, tasks); err != nil {
+		t.Errorf("checkEngines without engine-strict = %v, want only a warning", err)
+	}
+	cliFlags["engine-strict"] = []string{"true"}
+	if err := checkEngines(root, tasks); err == nil {
+		t.Error("checkEngines with engine-strict = nil, want an error")
+	}
+}
+
+func TestCheckEnginesSatisfied(t *testing.T) {
+	withFakeNode(t, "v18.2.0")
+	cliFlags["engine-strict"] = []string{"true"}
+	tasks := []InstallTask{{
+		Name:   "modern",
+		Locked: &LockedPackage{Version: "1.0.0", Engines: Engines{"node": ">=16"}},
+	}}
+	if err := checkEngines(&LockedPackage{}, tasks); err != nil {
+		t.Errorf("checkEngines = %v, want nil", err)
+	}
+}
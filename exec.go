@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const EXEC_COMPLETE_FILE = ".gopm-complete"
+
+// execCommand implements gopm exec and gopx: it runs a package's binary from
+// the local node_modules when it is installed there, and otherwise from a
+// cached install of the package kept under the gopm cache directory.
+func execCommand(args []string) {
+	if len(args) == 0 || args[0] == "--" {
+		ui.Error("usage: gopm exec <package>[@range] [-- args]")
+		exitCode = 1
+		return
+	}
+	arg, binArgs := args[0], scriptArgs(args[1:])
+	name, spec := splitPackageSpec(arg)
+	explicit := strings.LastIndex(arg, "@") > 0
+	if binary := localBinary(name, spec, explicit); binary != "" {
+		exitCode = runBinary(binary, binArgs, "")
+		return
+	}
+	binary, binDir, err := cachedExecBinary(name, spec)
+	if err != nil {
+		ui.Error(fmt.Sprintf("failed to run %s: %v", arg, err))
+		exitCode = 1
+		return
+	}
+	exitCode = runBinary(binary, binArgs, binDir)
+}
+
+// localBinary looks for name the way npx does: an installed package of that
+// name whose version matches spec, then a node_modules/.bin entry.
+func localBinary(name, spec string, explicit bool) string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	if pkgDir := resolvePackageDir(cwd, name); pkgDir != "" {
+		if version, err := getInstalledVersion(pkgDir); err == nil && (!explicit || satisfiesRange(version, spec)) {
+			if binary, err := packageBinary(pkgDir); err == nil {
+				return binary
+			}
+		}
+	}
+	if explicit {
+		return ""
+	}
+	for dir := cwd; ; {
+		candidate := filepath.Join(dir, NODE_MODULES_DIR, ".bin", name)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// packageBinary picks the binary to run from a package: its only bin, or the
+// one named after the package.
+func packageBinary(pkgDir string) (string, error) {
+	pkgJSON, err := readPackageJSONFromPath(filepath.Join(pkgDir, "package.json"))
+	if err != nil {
+		return "", err
+	}
+	baseName := pkgJSON.Name[strings.LastIndex(pkgJSON.Name, "/")+1:]
+	switch bin := pkgJSON.Bin.(type) {
+	case string:
+		return filepath.Join(pkgDir, bin), nil
+	case map[string]interface{}:
+		if len(bin) == 1 {
+			for _, path := range bin {
+				if pathStr, ok := path.(string); ok {
+					return filepath.Join(pkgDir, pathStr), nil
+				}
+			}
+		}
+		if path, ok := bin[baseName].(string); ok {
+			return filepath.Join(pkgDir, path), nil
+		}
+		names := make([]string, 0, len(bin))
+		for name := range bin {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return "", fmt.Errorf("%s has several binaries (%s) and none is named %s", pkgJSON.Name, strings.Join(names, ", "), baseName)
+	}
+	return "", fmt.Errorf("%s does not provide a binary", pkgJSON.Name)
+}
+
+// cachedExecBinary installs name@version into its own prefix under the cache
+// directory, unless a previous run already completed that install, and
+// returns the binary to run along with the prefix's bin directory.
+func cachedExecBinary(name, spec string) (string, string, error) {
+	registryData, err := getPackageFromRegistry(name)
+	if err != nil {
+		return "", "", err
+	}
+	version, err := resolveVersion(registryData, spec)
+	if err != nil {
+		return "", "", err
+	}
+	cacheDir, err := getCacheDir()
+	if err != nil {
+		return "", "", err
+	}
+	prefix := filepath.Join(cacheDir, "exec", url.PathEscape(name)+"@"+version)
+	libDir := filepath.Join(prefix, NODE_MODULES_DIR)
+	binDir := filepath.Join(prefix, "bin")
+	if _, err := os.Stat(filepath.Join(prefix, EXEC_COMPLETE_FILE)); err != nil {
+		startTime := time.Now()
+		ui.Info(fmt.Sprintf("installing %s@%s", name, version))
+		os.RemoveAll(prefix)
+		if err := os.MkdirAll(binDir, 0755); err != nil {
+			return "", "", err
+		}
+		results := installIntoPrefix(name, version, libDir, binDir)
+		for _, result := range results {
+			if result.failed() {
+				displayInstallResults(results, startTime)
+				return "", "", fmt.Errorf("installing %s@%s failed", name, version)
+			}
+		}
+		if err := os.WriteFile(filepath.Join(prefix, EXEC_COMPLETE_FILE), nil, 0644); err != nil {
+			return "", "", err
+		}
+	}
+	binary, err := packageBinary(filepath.Join(libDir, name))
+	return binary, binDir, err
+}
+
+// runBinary runs a package binary attached to the terminal, with the local
+// node_modules/.bin and extraBinDir ahead of PATH, and returns its exit code.
+func runBinary(binary string, args []string, extraBinDir string) int {
+	cmd := exec.Command(binary, args...)
+	// Installed files may be hardlinks into the store, so a binary that was
+	// packed without its executable bit is run through node rather than
+	// chmodded in place.
+	if info, err := os.Stat(binary); runtime.GOOS == "windows" || (err == nil && info.Mode()&0111 == 0) {
+		cmd = exec.Command("node", append([]string{binary}, args...)...)
+	}
+	binDirs := []string{filepath.Join(NODE_MODULES_DIR, ".bin")}
+	if cwd, err := os.Getwd(); err == nil {
+		binDirs[0] = filepath.Join(cwd, NODE_MODULES_DIR, ".bin")
+	}
+	if extraBinDir != "" {
+		binDirs = append(binDirs, extraBinDir)
+	}
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if !strings.EqualFold(key, "PATH") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, "PATH="+strings.Join(append(binDirs, os.Getenv("PATH")), string(os.PathListSeparator)))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() > 0 {
+			return exitErr.ExitCode()
+		}
+		ui.Error(fmt.Sprintf("failed to run %s: %v", filepath.Base(binary), err))
+		return 1
+	}
+	return 0
+}
@@ -10,6 +10,7 @@ export PATH=$PATH:/usr/local/go/bin
 git clone https://github.com/5quirre1/gopm.git
 cd gopm
 go build -o gopm
+ln -sf gopm gopx
 CURRENT_DIR="$(pwd)"
 SHELL_NAME=$(basename "$SHELL")
 
@@ -6,6 +6,8 @@ if not exist "gopm.exe" (
     pause
     exit /b 1
 )
+rem gopx is gopm exec under another name, picked by the name it is run as
+copy /y "gopm.exe" "gopx.exe" >nul
 set "CURRENT_DIR=%cd%"
 echo %PATH% | findstr /i "%CURRENT_DIR%" >nul
 if %errorlevel% == 0 (
@@ -5,6 +5,8 @@ if [[ ! -f "gopm" ]]; then
     exit 1
 fi
 chmod +x gopm
+# gopx is gopm exec under another name, picked by the name it is run as
+ln -sf gopm gopx
 CURRENT_DIR="$(pwd)"
 if echo "$PATH" | grep -q "$CURRENT_DIR"; then
     echo "gopm is already in PATH"
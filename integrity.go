@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+var integrityAlgorithms = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha512", sha512.New},
+	{"sha384", sha512.New384},
+	{"sha256", sha256.New},
+	{"sha1", sha1.New},
+}
+
+type IntegrityError struct {
+	Package  string
+	Expected string
+	Actual   string
+}
+
+func (e *IntegrityError) Error() string {
+	return fmt.Sprintf("integrity check failed for %s: expected %s, got %s", e.Package, e.Expected, e.Actual)
+}
+
+// integrityVerifier hashes everything written to it and compares the result
+// against the strongest supported hash in an SRI string.
+type integrityVerifier struct {
+	algorithm string
+	expected  []byte
+	hash      hash.Hash
+}
+
+func newIntegrityVerifier(sri string) (*integrityVerifier, error) {
+	hashes := make(map[string][]byte)
+	for _, field := range strings.Fields(sri) {
+		algorithm, digest, ok := strings.Cut(field, "-")
+		if !ok {
+			continue
+		}
+		if idx := strings.Index(digest, "?"); idx != -1 {
+			digest = digest[:idx]
+		}
+		raw, err := base64.StdEncoding.DecodeString(digest)
+		if err != nil {
+			return nil, fmt.Errorf("malformed integrity %q: %v", field, err)
+		}
+		hashes[algorithm] = raw
+	}
+	for _, algorithm := range integrityAlgorithms {
+		if expected, ok := hashes[algorithm.name]; ok {
+			return &integrityVerifier{
+				algorithm: algorithm.name,
+				expected:  expected,
+				hash:      algorithm.new(),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported integrity %q", sri)
+}
+
+func (v *integrityVerifier) Write(p []byte) (int, error) {
+	return v.hash.Write(p)
+}
+
+func (v *integrityVerifier) Verify(packageName string) error {
+	actual := v.hash.Sum(nil)
+	if bytes.Equal(actual, v.expected) {
+		return nil
+	}
+	return &IntegrityError{
+		Package:  packageName,
+		Expected: v.algorithm + "-" + base64.StdEncoding.EncodeToString(v.expected),
+		Actual:   v.algorithm + "-" + base64.StdEncoding.EncodeToString(actual),
+	}
+}
+
+func computeIntegrity(data []byte) string {
+	sum := sha512.Sum512(data)
+	return "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DEPENDENCY_LIFECYCLE are the scripts run for installed dependencies. The
+// root project additionally runs prepare, as npm does for a bare install.
+var (
+	DEPENDENCY_LIFECYCLE = []string{"preinstall", "install", "postinstall"}
+	ROOT_LIFECYCLE       = []string{"preinstall", "install", "postinstall", "prepare"}
+)
+
+type ScriptError struct {
+	Package  string
+	Event    string
+	Script   string
+	ExitCode int
+}
+
+func (e *ScriptError) Error() string {
+	return fmt.Sprintf("%s script failed with exit code %d: %s", e.Event, e.ExitCode, e.Script)
+}
+
+type lifecyclePackage struct {
+	name    string
+	dir     string
+	pkgJSON *PackageJSON
+	result  *InstallResult
+	deps    []string
+}
+
+func scriptsIgnored() bool {
+	return hasFlag("ignore-scripts") || getConfig().Get("ignore-scripts") == "true"
+}
+
+// scriptsAllowed reports whether a dependency may run its install scripts.
+// An empty allow-scripts setting allows every package, like npm.
+func scriptsAllowed(name string) bool {
+	allowList := getConfig().Get("allow-scripts")
+	if allowList == "" {
+		return true
+	}
+	for _, allowed := range strings.Split(allowList, ",") {
+		if strings.TrimSpace(allowed) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// lifecycleScripts returns the scripts a package defines for events, adding
+// npm's implicit "node-gyp rebuild" for packages that ship a binding.gyp.
+func lifecycleScripts(dir string, pkgJSON *PackageJSON, events []string) map[string]string {
+	scripts := make(map[string]string)
+	for _, event := range events {
+		if script := pkgJSON.Scripts[event]; script != "" {
+			scripts[event] = script
+		}
+	}
+	if scripts["install"] == "" && scripts["preinstall"] == "" {
+		if _, err := os.Stat(filepath.Join(dir, "binding.gyp")); err == nil {
+			scripts["install"] = "node-gyp rebuild"
+		}
+	}
+	return scripts
+}
+
+// runDependencyScripts runs the install scripts of every package that was
+// freshly extracted, dependencies before their dependents, and marks the
+// result of each package whose script exited non-zero as failed.
+func runDependencyScripts(baseDir string, results []InstallResult) {
+	if scriptsIgnored() {
+		return
+	}
+	packages := make(map[string]*lifecyclePackage)
+	var skipped []string
+	for i := range results {
+		result := &results[i]
+		if result.Error != nil || !result.Extracted {
+			continue
+		}
+		dir, err := filepath.Abs(filepath.Join(result.Task.Dir, result.Task.Name))
+		if err != nil {
+			continue
+		}
+		pkgJSON, err := readPackageJSONFromPath(filepath.Join(dir, "package.json"))
+		if err != nil || len(lifecycleScripts(dir, pkgJSON, DEPENDENCY_LIFECYCLE)) == 0 {
+			continue
+		}
+		if !scriptsAllowed(result.Task.Name) {
+			skipped = append(skipped, result.Task.Name)
+			continue
+		}
+		packages[dir] = &lifecyclePackage{name: result.Task.Name, dir: dir, pkgJSON: pkgJSON, result: result}
+	}
+	if len(skipped) > 0 {
+		sort.Strings(skipped)
+		ui.Warning(fmt.Sprintf("skipped install scripts for %s (not in allow-scripts)", strings.Join(skipped, ", ")))
+	}
+	if len(packages) == 0 {
+		return
+	}
+	for _, pkg := range packages {
+		for dep := range pkg.pkgJSON.Dependencies {
+			if depDir := resolvePackageDir(pkg.dir, dep); packages[depDir] != nil {
+				pkg.deps = append(pkg.deps, depDir)
+			}
+		}
+	}
+	ui.Header(fmt.Sprintf("running install scripts for %d packages", len(packages)))
+	rootDir, _ := filepath.Abs(baseDir)
+	for _, pkg := range dependencyOrder(packages) {
+		scripts := lifecycleScripts(pkg.dir, pkg.pkgJSON, DEPENDENCY_LIFECYCLE)
+		for _, event := range DEPENDENCY_LIFECYCLE {
+			if script, ok := scripts[event]; ok {
+				if err := runLifecycleScript(rootDir, pkg.dir, pkg.pkgJSON, event, script); err != nil {
+					pkg.result.Error = err
+					break
+				}
+			}
+		}
+	}
+}
+
+// runRootScripts runs the project's own install lifecycle once all of its
+// dependencies are in place. The allowlist does not apply to the project.
+func runRootScripts(pkgJSON *PackageJSON, results []InstallResult) error {
+	if scriptsIgnored() {
+		return nil
+	}
+	for _, result := range results {
+		if result.failed() {
+			ui.Warning(fmt.Sprintf("skipping %s install scripts because dependencies failed", pkgJSON.Name))
+			return nil
+		}
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	scripts := lifecycleScripts(dir, pkgJSON, ROOT_LIFECYCLE)
+	for _, event := range ROOT_LIFECYCLE {
+		if script, ok := scripts[event]; ok {
+			if err := runLifecycleScript(dir, dir, pkgJSON, event, script); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolvePackageDir finds name the way Node's require does from dir: in
+// dir/node_modules and then in each enclosing package's node_modules.
+func resolvePackageDir(dir, name string) string {
+	for {
+		candidate := filepath.Join(dir, NODE_MODULES_DIR, name)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+		parent := enclosingPackageDir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// enclosingPackageDir steps from a package directory out of its
+// node_modules (and scope) folder to the package that contains it.
+func enclosingPackageDir(dir string) string {
+	parent := filepath.Dir(dir)
+	for filepath.Base(parent) == NODE_MODULES_DIR || strings.HasPrefix(filepath.Base(parent), "@") {
+		parent = filepath.Dir(parent)
+	}
+	return parent
+}
+
+// dependencyOrder sorts packages so that each comes after the packages it
+// depends on. Cycles are broken at the first package visited.
+func dependencyOrder(packages map[string]*lifecyclePackage) []*lifecyclePackage {
+	dirs := make([]string, 0, len(packages))
+	for dir := range packages {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	visited := make(map[string]bool)
+	var ordered []*lifecyclePackage
+	var visit func(dir string)
+	visit = func(dir string) {
+		if visited[dir] {
+			return
+		}
+		visited[dir] = true
+		deps := append([]string(nil), packages[dir].deps...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			visit(dep)
+		}
+		ordered = append(ordered, packages[dir])
+	}
+	for _, dir := range dirs {
+		visit(dir)
+	}
+	return ordered
+}
+
+// runLifecycleScript runs one script with its output captured, printing the
+// output only when the script fails.
+func runLifecycleScript(rootDir, dir string, pkgJSON *PackageJSON, event, script string) error {
+	startTime := time.Now()
+	label := fmt.Sprintf("%s@%s", pkgJSON.Name, pkgJSON.Version)
+	cmd := scriptCommand(script)
+	cmd.Dir = dir
+	cmd.Env = scriptEnv(rootDir, dir, pkgJSON, event, script)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		exitStatus := -1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitStatus = exitErr.ExitCode()
+		}
+		ui.Error(fmt.Sprintf("%s %s failed: %s", label, event, script))
+		if output.Len() > 0 {
+			fmt.Print(indentOutput(output.String()))
+		}
+		return &ScriptError{Package: label, Event: event, Script: script, ExitCode: exitStatus}
+	}
+	ui.Success(fmt.Sprintf("%s %s ran in %v", label, event, time.Since(startTime).Round(time.Millisecond)))
+	return nil
+}
+
+// scriptCommand runs script through script-shell, or sh / cmd by default.
+func scriptCommand(script string) *exec.Cmd {
+	if shell := getConfig().Get("script-shell"); shell != "" {
+		return exec.Command(shell, "-c", script)
+	}
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/d", "/s", "/c", script)
+	}
+	return exec.Command("sh", "-c", script)
+}
+
+// scriptEnv builds the environment npm gives scripts: every node_modules/.bin
+// from dir up to the project root ahead of PATH, and npm_package_* and
+// npm_lifecycle_* describing what is running.
+func scriptEnv(rootDir, dir string, pkgJSON *PackageJSON, event, script string) []string {
+	var binDirs []string
+	for cur := dir; ; {
+		binDirs = append(binDirs, filepath.Join(cur, NODE_MODULES_DIR, ".bin"))
+		if cur == rootDir {
+			break
+		}
+		parent := enclosingPackageDir(cur)
+		if parent == cur {
+			break
+		}
+		cur = parent
+	}
+	initCwd, _ := os.Getwd()
+	env := make([]string, 0, len(os.Environ())+8)
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		if !strings.EqualFold(key, "PATH") {
+			env = append(env, kv)
+		}
+	}
+	return append(env,
+		"PATH="+strings.Join(append(binDirs, os.Getenv("PATH")), string(os.PathListSeparator)),
+		"INIT_CWD="+initCwd,
+		"npm_package_name="+pkgJSON.Name,
+		"npm_package_version="+pkgJSON.Version,
+		"npm_package_json="+filepath.Join(dir, "package.json"),
+		"npm_lifecycle_event="+event,
+		"npm_lifecycle_script="+script,
+		"npm_config_user_agent=gopm",
+	)
+}
+
+func indentOutput(output string) string {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	return "    " + strings.Join(lines, "\n    ") + "\n"
+}
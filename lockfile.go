@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	LOCKFILE_NAME    = "gopm-lock.json"
+	LOCKFILE_VERSION = 1
+)
+
+type LockedPackage struct {
+	Name                 string              `json:"name,omitempty"`
+	Version              string              `json:"version,omitempty"`
+	Resolved             string              `json:"resolved,omitempty"`
+	Integrity            string              `json:"integrity,omitempty"`
+	Link                 bool                `json:"link,omitempty"`
+	Dev                  bool                `json:"dev,omitempty"`
+	Peer                 bool                `json:"peer,omitempty"`
+	Optional             bool                `json:"optional,omitempty"`
+	Dependencies         map[string]string   `json:"dependencies,omitempty"`
+	DevDependencies      map[string]string   `json:"devDependencies,omitempty"`
+	PeerDependencies     map[string]string   `json:"peerDependencies,omitempty"`
+	PeerDependenciesMeta map[string]PeerMeta `json:"peerDependenciesMeta,omitempty"`
+	OptionalDependencies map[string]string   `json:"optionalDependencies,omitempty"`
+	OS                   []string            `json:"os,omitempty"`
+	CPU                  []string            `json:"cpu,omitempty"`
+	Libc                 []string            `json:"libc,omitempty"`
+	Engines              Engines             `json:"engines,omitempty"`
+}
+
+// realName is the registry name of a locked package, which differs from the
+// directory it is installed under for npm: aliases.
+func (p *LockedPackage) realName(installedAs string) string {
+	if p.Name != "" {
+		return p.Name
+	}
+	return installedAs
+}
+
+type Lockfile struct {
+	Name            string                    `json:"name"`
+	Version         string                    `json:"version"`
+	LockfileVersion int                       `json:"lockfileVersion"`
+	Packages        map[string]*LockedPackage `json:"packages"`
+}
+
+func newLockfile(pkgJSON *PackageJSON) *Lockfile {
+	lock := &Lockfile{
+		LockfileVersion: LOCKFILE_VERSION,
+		Packages:        make(map[string]*LockedPackage),
+	}
+	lock.setRoot(pkgJSON)
+	return lock
+}
+
+func (l *Lockfile) setRoot(pkgJSON *PackageJSON) {
+	root := rootPackage(pkgJSON)
+	if pkgJSON != nil {
+		l.Name = pkgJSON.Name
+		l.Version = pkgJSON.Version
+	}
+	l.Packages[""] = root
+}
+
+// rootPackage is the lockfile entry for the project itself, which unlike
+// any dependency also lists its devDependencies.
+func rootPackage(pkgJSON *PackageJSON) *LockedPackage {
+	root := &LockedPackage{Dependencies: map[string]string{}}
+	if pkgJSON == nil {
+		return root
+	}
+	root.Name = pkgJSON.Name
+	root.Version = pkgJSON.Version
+	for name, version := range pkgJSON.Dependencies {
+		root.Dependencies[name] = version
+	}
+	if len(pkgJSON.DevDependencies) > 0 {
+		root.DevDependencies = make(map[string]string)
+		for name, version := range pkgJSON.DevDependencies {
+			root.DevDependencies[name] = version
+		}
+	}
+	if len(pkgJSON.PeerDependencies) > 0 {
+		root.PeerDependencies = make(map[string]string)
+		for name, version := range pkgJSON.PeerDependencies {
+			root.PeerDependencies[name] = version
+		}
+	}
+	root.PeerDependenciesMeta = pkgJSON.PeerDependenciesMeta
+	root.Engines = pkgJSON.Engines
+	if len(pkgJSON.OptionalDependencies) > 0 {
+		root.OptionalDependencies = make(map[string]string)
+		for name, version := range pkgJSON.OptionalDependencies {
+			root.OptionalDependencies[name] = version
+		}
+	}
+	return root
+}
+
+// allDependencies merges every dependency section that gets installed into
+// one map; optional peers are left to whoever else needs them. A package
+// listed in several sections takes its range from optionalDependencies,
+// then dependencies, then devDependencies, as in npm.
+func (p *LockedPackage) allDependencies() map[string]string {
+	deps := make(map[string]string)
+	for name, version := range p.PeerDependencies {
+		if !p.PeerDependenciesMeta[name].Optional {
+			deps[name] = version
+		}
+	}
+	for name, version := range p.DevDependencies {
+		deps[name] = version
+	}
+	for name, version := range p.Dependencies {
+		deps[name] = version
+	}
+	for name, version := range p.OptionalDependencies {
+		deps[name] = version
+	}
+	return deps
+}
+
+// dependencyKind returns the kind of the section allDependencies takes
+// name's range from.
+func (p *LockedPackage) dependencyKind(name string) string {
+	if _, ok := p.OptionalDependencies[name]; ok {
+		return DEP_OPTIONAL
+	}
+	if _, ok := p.Dependencies[name]; ok {
+		return DEP_PROD
+	}
+	if _, ok := p.DevDependencies[name]; ok {
+		return DEP_DEV
+	}
+	if _, ok := p.PeerDependencies[name]; ok {
+		return DEP_PEER
+	}
+	return DEP_PROD
+}
+
+// addDependency lists name in the section for kind, and only there.
+func (p *LockedPackage) addDependency(name, spec, kind string) {
+	sections := map[string]*map[string]string{
+		DEP_PROD:     &p.Dependencies,
+		DEP_DEV:      &p.DevDependencies,
+		DEP_PEER:     &p.PeerDependencies,
+		DEP_OPTIONAL: &p.OptionalDependencies,
+	}
+	for _, deps := range sections {
+		delete(*deps, name)
+	}
+	deps := sections[kind]
+	if *deps == nil {
+		*deps = make(map[string]string)
+	}
+	(*deps)[name] = spec
+}
+
+func (l *Lockfile) rootDependencies() map[string]string {
+	if root, ok := l.Packages[""]; ok {
+		return root.allDependencies()
+	}
+	return map[string]string{}
+}
+
+// staleRoots returns the root dependencies whose range in package.json no
+// longer matches what was locked, and which therefore need re-resolving.
+func (l *Lockfile) staleRoots(rootDeps map[string]string) map[string]bool {
+	stale := make(map[string]bool)
+	locked := l.rootDependencies()
+	for name, version := range rootDeps {
+		if lockedVersion, ok := locked[name]; !ok || lockedVersion != version {
+			stale[name] = true
+			continue
+		}
+		entry, ok := l.Packages[lockPath(NODE_MODULES_DIR, name)]
+		if !ok {
+			stale[name] = true
+			continue
+		}
+		_, spec := parseDependencySpec(name, version)
+		if _, err := parseRange(spec); err == nil && !satisfiesRange(entry.Version, spec) {
+			stale[name] = true
+		}
+	}
+	return stale
+}
+
+// mismatches describes every way package.json and the lockfile disagree
+// about the root dependencies.
+func (l *Lockfile) mismatches(pkgJSON *PackageJSON) []string {
+	var problems []string
+	root := rootPackage(pkgJSON)
+	wanted := root.allDependencies()
+	locked := l.rootDependencies()
+	lockedRoot := l.Packages[""]
+	for name, version := range wanted {
+		lockedVersion, ok := locked[name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s@%s is missing from %s", name, version, LOCKFILE_NAME))
+		case lockedVersion != version:
+			problems = append(problems, fmt.Sprintf("%s is %s in package.json but %s in %s", name, version, lockedVersion, LOCKFILE_NAME))
+		case root.dependencyKind(name) != lockedRoot.dependencyKind(name):
+			problems = append(problems, fmt.Sprintf("%s is in a different dependency section in %s", name, LOCKFILE_NAME))
+		default:
+			if _, ok := l.Packages[lockPath(NODE_MODULES_DIR, name)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s has no resolved entry in %s", name, LOCKFILE_NAME))
+			}
+		}
+	}
+	for name := range locked {
+		if _, ok := wanted[name]; !ok {
+			problems = append(problems, fmt.Sprintf("%s is in %s but not in package.json", name, LOCKFILE_NAME))
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+// lockedTasks returns an install task for every locked package that is
+// fetched from a registry, leaving out workspace links, packages of the
+// omitted kinds and optional packages built for another platform.
+func (l *Lockfile) lockedTasks(omit map[string]bool) []InstallTask {
+	var tasks []InstallTask
+	for path, entry := range l.Packages {
+		if path == "" || entry.Link || (entry.Dev && omit[DEP_DEV]) || (entry.Peer && omit[DEP_PEER]) {
+			continue
+		}
+		if entry.Optional && (omit[DEP_OPTIONAL] || entry.platformError() != nil) {
+			continue
+		}
+		dir, name := splitLockPath(path)
+		tasks = append(tasks, InstallTask{
+			Name:     name,
+			Version:  entry.Version,
+			Dir:      dir,
+			IsRoot:   dir == NODE_MODULES_DIR,
+			Optional: entry.Optional,
+			Locked:   entry,
+		})
+	}
+	return tasks
+}
+
+// links returns the workspace links the lockfile records, by lock path.
+func (l *Lockfile) links() map[string]string {
+	links := make(map[string]string)
+	for path, entry := range l.Packages {
+		if entry.Link {
+			links[path] = entry.Resolved
+		}
+	}
+	return links
+}
+
+// forget returns a copy of the lockfile without the named root packages and
+// everything nested in them, so the resolver picks them afresh. With no
+// names it keeps only the root entry and workspace links.
+func (l *Lockfile) forget(names []string) *Lockfile {
+	copied := *l
+	copied.Packages = make(map[string]*LockedPackage)
+	for path, entry := range l.Packages {
+		if path == "" || entry.Link {
+			copied.Packages[path] = entry
+			continue
+		}
+		if len(names) == 0 {
+			continue
+		}
+		forgotten := false
+		for _, name := range names {
+			top := lockPath(NODE_MODULES_DIR, name)
+			if path == top || strings.HasPrefix(path, top+"/") {
+				forgotten = true
+				break
+			}
+		}
+		if !forgotten {
+			copied.Packages[path] = entry
+		}
+	}
+	return &copied
+}
+
+// setTree replaces the locked packages with everything placed in tree.
+func (l *Lockfile) setTree(tree *depTree) {
+	root := l.Packages[""]
+	l.Packages = map[string]*LockedPackage{"": root}
+	tree.walk(func(node *depNode) {
+		l.Packages[node.path] = node.pkg
+	})
+}
+
+func lockPath(dir, name string) string {
+	return filepath.ToSlash(filepath.Join(dir, name))
+}
+
+func splitLockPath(path string) (string, string) {
+	idx := strings.LastIndex(path, NODE_MODULES_DIR+"/")
+	dir := filepath.FromSlash(path[:idx+len(NODE_MODULES_DIR)])
+	return dir, path[idx+len(NODE_MODULES_DIR)+1:]
+}
+
+func readLockfile() (*Lockfile, error) {
+	data, err := os.ReadFile(LOCKFILE_NAME)
+	if err != nil {
+		return nil, err
+	}
+	var lock Lockfile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	if lock.Packages == nil {
+		lock.Packages = make(map[string]*LockedPackage)
+	}
+	return &lock, nil
+}
+
+func writeLockfile(lock *Lockfile) error {
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(LOCKFILE_NAME, append(data, '\n'), 0644)
+}
+
+func readLockfileOrWarn() *Lockfile {
+	lock, err := readLockfile()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			ui.Warning(fmt.Sprintf("ignoring unreadable %s: %v", LOCKFILE_NAME, err))
+		}
+		return nil
+	}
+	return lock
+}
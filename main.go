@@ -3,10 +3,12 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
@@ -16,8 +18,6 @@ import (
 	"github.com/fatih/color"
 	"github.com/schollz/progressbar/v3"
 	"runtime"
-	"regexp"
-    "strconv"
 )
 type Author struct {
     Name  string `json:"name"`
@@ -96,9 +96,17 @@ type Package struct {
 	Repository   Repository             `json:"repository"`
 	Dependencies map[string]string      `json:"dependencies"`
 	DevDeps      map[string]string      `json:"devDependencies"`
+	PeerDependencies     map[string]string   `json:"peerDependencies"`
+	PeerDependenciesMeta map[string]PeerMeta `json:"peerDependenciesMeta"`
+	OptionalDependencies map[string]string   `json:"optionalDependencies"`
+	OS           []string               `json:"os"`
+	CPU          []string               `json:"cpu"`
+	Libc         []string               `json:"libc"`
+	Engines      Engines                `json:"engines"`
 	Dist         struct {
-		Tarball string `json:"tarball"`
-		Shasum  string `json:"shasum"`
+		Tarball   string `json:"tarball"`
+		Shasum    string `json:"shasum"`
+		Integrity string `json:"integrity"`
 	} `json:"dist"`
 }
 type RegistryResponse struct {
@@ -120,18 +128,32 @@ type PackageJSON struct {
     License         string                 `json:"license"`
     Dependencies    map[string]string      `json:"dependencies"`
     DevDependencies map[string]string      `json:"devDependencies"`
+    PeerDependencies     map[string]string   `json:"peerDependencies"`
+    PeerDependenciesMeta map[string]PeerMeta `json:"peerDependenciesMeta"`
+    OptionalDependencies map[string]string   `json:"optionalDependencies"`
+    Engines         Engines                `json:"engines"`
+    Workspaces      Workspaces             `json:"workspaces,omitempty"`
 }
 type InstallTask struct {
 	Name    string
 	Version string
 	Dir     string
 	IsRoot  bool
+	Optional bool
+	Locked  *LockedPackage
 }
 type InstallResult struct {
 	Task   InstallTask
 	Error  error
 	Size   int64
 	Duration time.Duration
+	Resolved *LockedPackage
+	Extracted bool
+}
+// failed reports an error that fails the install. Optional dependencies
+// that cannot be installed are only warned about, as npm does.
+func (r InstallResult) failed() bool {
+	return r.Error != nil && !r.Task.Optional
 }
 type UI struct {
 	green   *color.Color
@@ -176,17 +198,11 @@ const (
 	NPM_REGISTRY_URL = "https://registry.npmjs.org"
 	NODE_MODULES_DIR = "node_modules"
 	MAX_CONCURRENT  = 10
+	GOPM_VERSION    = "1.1.1"
 )
 var (
 	ui = NewUI()
-	httpClient = &http.Client{
-		Timeout: 30 * time.Second,
-		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 10,
-			IdleConnTimeout:     90 * time.Second,
-		},
-	}
+	exitCode = 0
 )
 func getGlobalInstallDir() (string, error) {
 	if customRoot := os.Getenv("GOPM_ROOT"); customRoot != "" {
@@ -207,6 +223,7 @@ func showLocalRoot() {
     cwd, err := os.Getwd()
     if err != nil {
         ui.Error(fmt.Sprintf("failed to get current directory: %v", err))
+        exitCode = 1
         return
     }
     localRoot := filepath.Join(cwd, "node_modules")
@@ -222,6 +239,7 @@ func showGlobalRoot() {
     globalDir, err := getGlobalInstallDir()
     if err != nil {
         ui.Error(fmt.Sprintf("failed to determine global directory: %v", err))
+        exitCode = 1
         return
     }
     ui.Header("Global node_modules directory")
@@ -233,12 +251,24 @@ func showGlobalRoot() {
     }
 }
 func main() {
-	ui.Header("gopm - faster npm")
+	if strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe") == "gopx" {
+		os.Args = append([]string{os.Args[0], "exec"}, os.Args[1:]...)
+	}
+	os.Args = append(os.Args[:1], parseFlags(os.Args[1:])...)
+	// --json output, and whatever a binary run by exec prints, has to be
+	// the only thing on stdout
+	execing := len(os.Args) > 1 && (os.Args[1] == "exec" || os.Args[1] == "x")
+	if !hasFlag("json") && !execing {
+		ui.Header("gopm - faster npm")
+	}
 	if len(os.Args) < 2 {
 		printUsage()
 		return
 	}
-	command := os.Args[1]
+	runCommand(os.Args[1])
+	os.Exit(exitCode)
+}
+func runCommand(command string) {
 	switch command {
 	case "install", "i":
 		if len(os.Args) < 3 {
@@ -248,6 +278,7 @@ func main() {
 		if os.Args[2] == "-g" {
 			if len(os.Args) < 4 {
 				ui.Error("usage: gopm install -g <package> [version]")
+				exitCode = 1
 				return
 			}
 			packageName := os.Args[3]
@@ -264,9 +295,12 @@ func main() {
 			}
 			installPackage(packageName, version)
 		}
+	case "ci", "clean-install":
+		cleanInstall()
 	case "uninstall", "rm":
 		if len(os.Args) < 3 {
 			ui.Error("usage: gopm uninstall <package> [-g]")
+			exitCode = 1
 			return
 		}
 		if len(os.Args) > 3 && os.Args[3] == "-g" {
@@ -274,23 +308,23 @@ func main() {
 		} else {
 			uninstallPackage(os.Args[2])
 		}
-	case "update":
-		if len(os.Args) == 2 {
-			updateAllPackages()
-		} else {
-			updatePackage(os.Args[2])
-		}
+	case "update", "up":
+		updatePackages(os.Args[2:], hasFlag("latest"))
+	case "upgrade":
+		upgradeCommand(os.Args[2:])
 	case "init":
 		initPackage()
 	case "info":
 		if len(os.Args) < 3 {
 			ui.Error("usage: gopm info <package-name>")
+			exitCode = 1
 			return
 		}
 		showPackageInfo(os.Args[2])
 	case "search":
 		if len(os.Args) < 3 {
 			ui.Error("usage: gopm search <query>")
+			exitCode = 1
 			return
 		}
 		searchPackages(os.Args[2])
@@ -300,8 +334,21 @@ func main() {
 		} else {
 			listPackages()
 		}
+	case "cache":
+		cacheCommand(os.Args[2:])
+	case "exec", "x":
+		execCommand(os.Args[2:])
+	case "run", "run-script":
+		runCommandScripts(os.Args[2:])
+	case "test", "t", "start":
+		if command == "t" {
+			command = "test"
+		}
+		runCommandScripts(append([]string{command}, os.Args[2:]...))
+	case "outdated":
+		outdatedCommand(os.Args[2:])
 	case "version":
-		ui.Info("gopm version 1.1.1")
+		ui.Info("gopm version " + GOPM_VERSION)
 	case "root":
 	    if len(os.Args) > 2 && os.Args[2] == "-g" {
 	        showGlobalRoot()
@@ -309,89 +356,160 @@ func main() {
 	        showLocalRoot()
 	    }
 	default:
+		ui.Error(fmt.Sprintf("unknown command: %s", command))
 		printUsage()
+		exitCode = 1
 	}
 }
 func printUsage() {
 	ui.Header("usage")
 	fmt.Println("  gopm install [-g] [package] [version]   install package(s) (global if -g)")
+	fmt.Println("  gopm ci                            clean install exactly what gopm-lock.json records")
 	fmt.Println("  gopm root [-g]                     show node_modules directory path (global if -g)")
 	fmt.Println("  gopm uninstall [package] [-g]      uninstall package(s) (global if -g)")
-	fmt.Println("  gopm update [package]              update one or all packages to latest version (global if -g)")
+	fmt.Println("  gopm update [package...]           update packages to the newest versions their ranges allow")
+	fmt.Println("  gopm update --latest [package...]  update packages to their latest versions, rewriting ranges")
 	fmt.Println("  gopm init                          initialize package.json")
 	fmt.Println("  gopm info <package>                show package info")
 	fmt.Println("  gopm search <query>                search packages")
 	fmt.Println("  gopm list [-g]                     list installed packages (global if -g)")
+	fmt.Println("  gopm cache <ls|verify|clean|add>   inspect, verify, clean or pre-warm the package cache")
+	fmt.Println("  gopm run [script] [-- args]        run a package.json script, or list them")
+	fmt.Println("  gopm test / gopm start             run the test or start script")
+	fmt.Println("  gopm exec <package>[@range] [args] run a package binary without installing it (also gopx)")
+	fmt.Println("  gopm upgrade -i                    pick outdated packages to upgrade to their latest versions")
+	fmt.Println("  gopm outdated [package] [--json]   list dependencies behind their wanted or latest version")
 	fmt.Println("  gopm version                       show version")
+	ui.Header("options")
+	fmt.Println("  --offline                          only use cached metadata and tarballs (install, ci, info)")
+	fmt.Println("  --prefer-offline                   use the cache when possible, only fetch misses")
+	fmt.Println("  -D, --save-dev                     save to devDependencies (-O --save-optional, --save-peer)")
+	fmt.Println("  -E, --save-exact                   save the exact version instead of save-prefix (default ^)")
+	fmt.Println("  --no-save                          do not record the install in package.json")
+	fmt.Println("  --omit <dev|optional|peer>         leave these out of node_modules (--production, NODE_ENV=production: dev)")
+	fmt.Println("  --os <os>, --cpu <cpu>             pick optional dependencies for another platform (also --libc)")
+	fmt.Println("  --strict-peer-deps                 fail on peer dependency conflicts instead of warning")
+	fmt.Println("  --legacy-peer-deps                 ignore peer dependencies, like npm 6")
+	fmt.Println("  --engine-strict                    fail instead of warning when engines.node or engines.gopm do not match")
+	fmt.Println("  --ignore-scripts                   do not run install scripts (allow-scripts in .npmrc limits which may)")
+	fmt.Println("  -w, --workspace <name>             run a script in one workspace (repeatable)")
+	fmt.Println("  --workspaces                       run a script in every workspace that has it")
 }
 func installFromPackageJSON() {
     startTime := time.Now()
     packageJSON, err := readPackageJSON()
     if err != nil {
         ui.Error(fmt.Sprintf("error reading package.json: %v", err))
+        exitCode = 1
+        return
+    }
+    workspaces, err := findWorkspaces(".", packageJSON)
+    if err != nil {
+        ui.Error(fmt.Sprintf("error reading workspaces: %v", err))
+        exitCode = 1
         return
     }
-    if len(packageJSON.Dependencies) == 0 {
+    root := rootPackage(packageJSON)
+    rootDeps := root.allDependencies()
+    if len(rootDeps) == 0 && len(workspaces) == 0 {
         ui.Warning("no dependencies found in package.json")
         return
     }
-    ui.Header(fmt.Sprintf("installing %d dependencies", len(packageJSON.Dependencies)))
-    var queue []InstallTask
-    installed := make(map[string]bool)
-    for name, version := range packageJSON.Dependencies {
-        queue = append(queue, InstallTask{
-            Name:    name,
-            Version: version,
-            Dir:     NODE_MODULES_DIR,
-            IsRoot:  true,
-        })
-    }
-    var results []InstallResult
-    var mu sync.Mutex
-    for len(queue) > 0 {
-        currentBatch := queue
-        queue = nil
-        batchResults := installPackagesConcurrently(currentBatch)
-        results = append(results, batchResults...)
-        var wg sync.WaitGroup
-        for _, result := range batchResults {
-            if result.Error != nil {
-                continue
-            }
-            wg.Add(1)
-            go func(task InstallTask) {
-                defer wg.Done()
-                packageDir := filepath.Join(task.Dir, task.Name)
-                packageJSONPath := filepath.Join(packageDir, "package.json")
-                pkgJSON, err := readPackageJSONFromPath(packageJSONPath)
-                if err != nil {
-                    return
-                }
-                mu.Lock()
-                defer mu.Unlock()
-                for depName, depVersion := range pkgJSON.Dependencies {
-                    if !installed[depName] {
-                        installed[depName] = true
-                        queue = append(queue, InstallTask{
-                            Name:    depName,
-                            Version: depVersion,
-                            Dir:     filepath.Join(packageDir, "node_modules"),
-                            IsRoot:  false,
-                        })
-                    }
-                }
-            }(result.Task)
+    ui.Header(fmt.Sprintf("installing %d dependencies", len(rootDeps)))
+    if len(workspaces) > 0 {
+        ui.Info(fmt.Sprintf("linking %d workspaces", len(workspaces)))
+    }
+    lock := readLockfileOrWarn()
+    tree, results, err := resolveAndInstall(".", root, lock, workspaces)
+    if err != nil {
+        if len(results) > 0 {
+            displayInstallResults(results, startTime)
         }
-        wg.Wait()
+        ui.Error(err.Error())
+        exitCode = 1
+        return
+    }
+    if lock == nil {
+        lock = newLockfile(packageJSON)
+    }
+    lock.setRoot(packageJSON)
+    lock.setTree(tree)
+    if err := writeLockfile(lock); err != nil {
+        ui.Error(fmt.Sprintf("failed to write %s: %v", LOCKFILE_NAME, err))
     }
     if err := linkLocalBinaries(); err != nil {
         ui.Error(fmt.Sprintf("failed to link binaries: %v", err))
     }
+    runDependencyScripts(".", results)
+    if err := runRootScripts(packageJSON, results); err != nil {
+        exitCode = 1
+    }
     displayInstallResults(results, startTime)
     localBinPath := filepath.Join(NODE_MODULES_DIR, ".bin")
     ui.Info("\nto use locally installed binaries, add to your PATH:")
     ui.Info(fmt.Sprintf("  export PATH=$PATH:%s", localBinPath))
 }
+func cleanInstall() {
+    startTime := time.Now()
+    exitCode = 1
+    packageJSON, err := readPackageJSON()
+    if err != nil {
+        ui.Error(fmt.Sprintf("error reading package.json: %v", err))
+        return
+    }
+    lock, err := readLockfile()
+    if err != nil {
+        ui.Error(fmt.Sprintf("gopm ci requires a readable %s: %v", LOCKFILE_NAME, err))
+        return
+    }
+    workspaces, err := findWorkspaces(".", packageJSON)
+    if err != nil {
+        ui.Error(fmt.Sprintf("error reading workspaces: %v", err))
+        return
+    }
+    if problems := append(lock.mismatches(packageJSON), lock.workspaceMismatches(workspaces)...); len(problems) > 0 {
+        ui.Error(fmt.Sprintf("package.json and %s are out of sync:", LOCKFILE_NAME))
+        for _, problem := range problems {
+            fmt.Printf("  • %s\n", problem)
+        }
+        ui.Info("run gopm install to update the lockfile")
+        return
+    }
+    // engine-strict aborts before the existing install is removed
+    tasks := lock.lockedTasks(omittedKinds())
+    ui.Header(fmt.Sprintf("clean installing %d packages from %s", len(tasks), LOCKFILE_NAME))
+    if err := checkEngines(rootPackage(packageJSON), tasks); err != nil {
+        ui.Error(err.Error())
+        return
+    }
+    for _, ws := range workspaces {
+        if err := os.RemoveAll(filepath.Join(filepath.FromSlash(ws.Dir), NODE_MODULES_DIR)); err != nil {
+            ui.Error(fmt.Sprintf("failed to remove %s: %v", NODE_MODULES_DIR, err))
+            return
+        }
+    }
+    if err := os.RemoveAll(NODE_MODULES_DIR); err != nil {
+        ui.Error(fmt.Sprintf("failed to remove %s: %v", NODE_MODULES_DIR, err))
+        return
+    }
+    for path, target := range lock.links() {
+        if err := linkWorkspace(".", path, target); err != nil {
+            ui.Error(fmt.Sprintf("failed to link workspace %s: %v", target, err))
+            return
+        }
+    }
+    exitCode = 0
+    results := installPackagesConcurrently(tasks)
+    if err := linkLocalBinaries(); err != nil {
+        ui.Error(fmt.Sprintf("failed to link binaries: %v", err))
+        exitCode = 1
+    }
+    runDependencyScripts(".", results)
+    if err := runRootScripts(packageJSON, results); err != nil {
+        exitCode = 1
+    }
+    displayInstallResults(results, startTime)
+}
 func installPackage(name, version string) {
     startTime := time.Now()
     ui.Header(fmt.Sprintf("installing %s@%s", name, version))
@@ -399,58 +517,64 @@ func installPackage(name, version string) {
         parts := strings.Split(name, "/")
         if len(parts) != 2 {
             ui.Error("invalid scoped package name")
+            exitCode = 1
             return
         }
     }
-    tasks := []InstallTask{{
-        Name:    name,
-        Version: version,
-        Dir:     NODE_MODULES_DIR,
-        IsRoot:  true,
-    }}
-    results := installPackagesConcurrently(tasks)
-    if len(results) == 0 || results[0].Error != nil {
-        displayInstallResults(results, startTime)
-        return
-    }
-    packageDir := filepath.Join(NODE_MODULES_DIR, name)
-    if strings.HasPrefix(name, "@") {
-        parts := strings.Split(name, "/")
-        packageDir = filepath.Join(NODE_MODULES_DIR, parts[0], parts[1])
+    root := rootPackage(nil)
+    var workspaces []Workspace
+    if packageJSON, err := readPackageJSON(); err == nil {
+        root = rootPackage(packageJSON)
+        if workspaces, err = findWorkspaces(".", packageJSON); err != nil {
+            ui.Error(fmt.Sprintf("error reading workspaces: %v", err))
+            exitCode = 1
+            return
+        }
     }
-    packageJSONPath := filepath.Join(packageDir, "package.json")
-    pkgJSON, err := readPackageJSONFromPath(packageJSONPath)
+    kind := root.dependencyKind(name)
+    switch {
+    case hasFlag("save-dev"):
+        kind = DEP_DEV
+    case hasFlag("save-peer"):
+        kind = DEP_PEER
+    case hasFlag("save-optional"):
+        kind = DEP_OPTIONAL
+    }
+    root.addDependency(name, version, kind)
+    lock := readLockfileOrWarn()
+    tree, results, err := resolveAndInstall(".", root, lock, workspaces)
     if err != nil {
-        ui.Error(fmt.Sprintf("failed to read package.json for %s: %v", name, err))
+        if len(results) > 0 {
+            displayInstallResults(results, startTime)
+        }
+        ui.Error(err.Error())
+        exitCode = 1
         return
     }
-    if len(pkgJSON.Dependencies) > 0 {
-        ui.Info(fmt.Sprintf("installing %d dependencies for %s", len(pkgJSON.Dependencies), name))
-        depTasks := make([]InstallTask, 0, len(pkgJSON.Dependencies))
-        for depName, depVersion := range pkgJSON.Dependencies {
-            depDir := filepath.Join(packageDir, "node_modules")
-            if strings.HasPrefix(depName, "@") {
-                parts := strings.Split(depName, "/")
-                depDir = filepath.Join(depDir, parts[0])
-            }
-            depTasks = append(depTasks, InstallTask{
-                Name:    depName,
-                Version: depVersion,
-                Dir:     depDir,
-                IsRoot:  false,
-            })
-        }
-        depResults := installPackagesConcurrently(depTasks)
-        results = append(results, depResults...)
+    if _, ok := tree.root.edges[name]; !ok {
+        displayInstallResults(results, startTime)
+        return
     }
     if err := linkLocalBinaries(); err != nil {
         ui.Error(fmt.Sprintf("failed to link binaries: %v", err))
     }
-    if shouldUpdatePackageJSON(name) {
-        if err := addToPackageJSON(name, version); err != nil {
+    runDependencyScripts(".", results)
+    if _, err := os.Stat("package.json"); err == nil && boolOption("save", true) {
+        section, spec, err := saveToPackageJSON(name, version, tree.root.edges[name].pkg.Version)
+        if err != nil {
             ui.Error(fmt.Sprintf("failed to update package.json: %v", err))
         } else {
-            ui.Info("updated package.json")
+            ui.Info(fmt.Sprintf("saved %s@%s to %s", name, spec, section))
+        }
+    }
+    if packageJSON, err := readPackageJSON(); err == nil {
+        if lock == nil {
+            lock = newLockfile(packageJSON)
+        }
+        lock.setRoot(packageJSON)
+        lock.setTree(tree)
+        if err := writeLockfile(lock); err != nil {
+            ui.Error(fmt.Sprintf("failed to write %s: %v", LOCKFILE_NAME, err))
         }
     }
     displayInstallResults(results, startTime)
@@ -470,7 +594,8 @@ func linkLocalBinaries() error {
         return err
     }
     for _, entry := range entries {
-        if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+        isLink := entry.Type()&os.ModeSymlink != 0
+        if (entry.IsDir() || isLink) && !strings.HasPrefix(entry.Name(), ".") {
             packageDir := filepath.Join(NODE_MODULES_DIR, entry.Name())
             packageJSONPath := filepath.Join(packageDir, "package.json")
             pkgJSON, err := readPackageJSONFromPath(packageJSONPath)
@@ -517,95 +642,135 @@ func createBinLink(src, dest string) error {
     }
     return os.Symlink(relPath, dest)
 }
-func shouldUpdatePackageJSON(packageName string) bool {
-    if _, err := os.Stat("package.json"); os.IsNotExist(err) {
-        return false
-    }
-    for _, arg := range os.Args {
-        if arg == packageName {
-            return true
+// saveToPackageJSON records an installed package in package.json and returns
+// the section and range it was saved under.
+func saveToPackageJSON(name, requested, resolved string) (string, string, error) {
+    pkgFile, err := loadPackageJSONFile("package.json")
+    if err != nil {
+        return "", "", err
+    }
+    section := saveSection(pkgFile, name)
+    spec := saveSpec(requested, resolved)
+    for _, other := range DEPENDENCY_SECTIONS {
+        // a peer dependency is usually also a dev dependency, so keep that one
+        if other != section && !(section == "peerDependencies" && other == "devDependencies") {
+            pkgFile.RemoveDependency(other, name)
         }
     }
-    return false
+    pkgFile.SetDependency(section, name, spec)
+    return section, spec, pkgFile.Save()
 }
-func addToPackageJSON(name, version string) error {
-    pkgJSON, err := readPackageJSON()
-    if err != nil {
-        return err
+// saveSection picks the section for --save-dev, --save-optional and
+// --save-peer. Without one, a package stays in the section it is already
+// listed in, and new packages go to dependencies.
+func saveSection(pkgFile *PackageJSONFile, name string) string {
+    switch {
+    case hasFlag("save-dev"):
+        return "devDependencies"
+    case hasFlag("save-optional"):
+        return "optionalDependencies"
+    case hasFlag("save-peer"):
+        return "peerDependencies"
+    }
+    for _, section := range DEPENDENCY_SECTIONS {
+        if _, ok := pkgFile.Dependencies(section).specs[name]; ok {
+            return section
+        }
     }
-    if pkgJSON.Dependencies == nil {
-        pkgJSON.Dependencies = make(map[string]string)
+    return "dependencies"
+}
+// saveSpec is the range written for a package installed as requested that
+// resolved to resolved. Tags and exact versions are saved as save-prefix
+// (default ^) plus the resolved version, or the bare version with
+// --save-exact; ranges and aliases are saved as given.
+func saveSpec(requested, resolved string) string {
+    if strings.HasPrefix(requested, "npm:") {
+        return requested
+    }
+    if _, err := parseSemVer(requested); err != nil {
+        if _, err := parseRange(requested); err == nil {
+            return requested
+        }
     }
-    if _, exists := pkgJSON.Dependencies[name]; !exists {
-        pkgJSON.Dependencies[name] = version
+    if boolOption("save-exact", false) {
+        return resolved
     }
-    data, err := json.MarshalIndent(pkgJSON, "", "  ")
-    if err != nil {
-        return err
+    return savePrefix() + resolved
+}
+func savePrefix() string {
+    if prefix, ok := getConfig().values["save-prefix"]; ok {
+        return prefix
     }
-    return os.WriteFile("package.json", data, 0644)
+    return "^"
 }
 func installPackageGlobal(name, version string) {
     startTime := time.Now()
     globalDir, err := getGlobalInstallDir()
     if err != nil {
         ui.Error(fmt.Sprintf("failed to determine global installation directory: %v", err))
+        exitCode = 1
         return
     }
     binDir := filepath.Dir(globalDir)
     binDir = filepath.Join(binDir, "bin")
     if err := os.MkdirAll(binDir, 0755); err != nil {
         ui.Error(fmt.Sprintf("failed to create bin directory: %v", err))
+        exitCode = 1
         return
     }
     if err := os.MkdirAll(globalDir, 0755); err != nil {
         ui.Error(fmt.Sprintf("failed to create global directory: %v", err))
+        exitCode = 1
         return
     }
     ui.Header(fmt.Sprintf("installing %s@%s globally", name, version))
+    results := installIntoPrefix(name, version, globalDir, binDir)
+    displayInstallResults(results, startTime)
+    if len(results) == 0 || results[0].Error != nil {
+        return
+    }
+    ui.Info(fmt.Sprintf("package installed globally to: %s", globalDir))
+    ui.Info(fmt.Sprintf("binaries linked to: %s", binDir))
+    pathEnv := os.Getenv("PATH")
+    if !strings.Contains(pathEnv, binDir) {
+        ui.Warning("\nglobal bin directory not found in PATH. add this to your shell configuration:")
+        ui.Info(fmt.Sprintf("  export PATH=$PATH:%s", binDir))
+    }
+}
+// installIntoPrefix installs a package with its own nested dependencies
+// into libDir, runs its install scripts and links its binaries into binDir.
+func installIntoPrefix(name, version, libDir, binDir string) []InstallResult {
     tasks := []InstallTask{{
         Name:    name,
         Version: version,
-        Dir:     globalDir,
+        Dir:     libDir,
         IsRoot:  true,
     }}
     results := installPackagesConcurrently(tasks)
     if len(results) == 0 || results[0].Error != nil {
-        displayInstallResults(results, startTime)
-        return
+        return results
     }
-    packageDir := filepath.Join(globalDir, name)
+    packageDir := filepath.Join(libDir, name)
     packageJSONPath := filepath.Join(packageDir, "package.json")
     pkgJSON, err := readPackageJSONFromPath(packageJSONPath)
     if err != nil {
-        ui.Error(fmt.Sprintf("failed to read package.json for %s: %v", name, err))
-        return
+        results[0].Error = fmt.Errorf("failed to read package.json: %v", err)
+        return results
     }
     if len(pkgJSON.Dependencies) > 0 {
         ui.Info(fmt.Sprintf("installing %d dependencies for %s", len(pkgJSON.Dependencies), name))
-        depTasks := make([]InstallTask, 0, len(pkgJSON.Dependencies))
-        for depName, depVersion := range pkgJSON.Dependencies {
-            depTasks = append(depTasks, InstallTask{
-                Name:    depName,
-                Version: depVersion,
-                Dir:     filepath.Join(packageDir, "node_modules"),
-                IsRoot:  false,
-            })
-        }
-        depResults := installPackagesConcurrently(depTasks)
+        _, depResults, err := resolveAndInstall(packageDir, &LockedPackage{Dependencies: pkgJSON.Dependencies}, nil, nil)
         results = append(results, depResults...)
+        if err != nil {
+            results[0].Error = err
+            return results
+        }
     }
+    runDependencyScripts(libDir, results)
     if err := linkGlobalBinaries(packageDir, binDir); err != nil {
         ui.Error(fmt.Sprintf("failed to link binaries: %v", err))
     }
-    displayInstallResults(results, startTime)
-    ui.Info(fmt.Sprintf("package installed globally to: %s", globalDir))
-    ui.Info(fmt.Sprintf("binaries linked to: %s", binDir))
-    pathEnv := os.Getenv("PATH")
-    if !strings.Contains(pathEnv, binDir) {
-        ui.Warning("\nglobal bin directory not found in PATH. add this to your shell configuration:")
-        ui.Info(fmt.Sprintf("  export PATH=$PATH:%s", binDir))
-    }
+    return results
 }
 func linkGlobalBinaries(packageDir, binDir string) error {
     packageJSONPath := filepath.Join(packageDir, "package.json")
@@ -649,43 +814,103 @@ return os.WriteFile(dest+".cmd", []byte(cmdContent), 0644)
         return os.Symlink(relPath, dest)
     }
 }
+// uninstallPackage removes name from package.json and re-resolves the rest
+// of the tree from the lockfile, so dependencies only name needed are
+// removed with it and gopm-lock.json stays in sync. Nothing is changed on
+// disk when resolution aborts.
 func uninstallPackage(name string) {
+	startTime := time.Now()
 	ui.Header(fmt.Sprintf("uninstalling %s", name))
 	packageDir := filepath.Join(NODE_MODULES_DIR, name)
-	if _, err := os.Stat(packageDir); os.IsNotExist(err) {
-		ui.Warning(fmt.Sprintf("package '%s' is not installed", name))
+	pkgFile, err := loadPackageJSONFile("package.json")
+	removed := false
+	if err == nil {
+		for _, section := range DEPENDENCY_SECTIONS {
+			if pkgFile.RemoveDependency(section, name) {
+				removed = true
+			}
+		}
+	}
+	if !removed {
+		if _, err := os.Stat(packageDir); os.IsNotExist(err) {
+			ui.Warning(fmt.Sprintf("package '%s' is not installed", name))
+			return
+		}
+		if err := os.RemoveAll(packageDir); err != nil {
+			ui.Error(fmt.Sprintf("failed to uninstall %s: %v", name, err))
+			exitCode = 1
+			return
+		}
+		ui.Success(fmt.Sprintf("uninstalled %s", name))
 		return
 	}
-	err := os.RemoveAll(packageDir)
+	packageJSON, err := readPackageJSON()
 	if err != nil {
-		ui.Error(fmt.Sprintf("failed to uninstall %s: %v", name, err))
+		ui.Error(fmt.Sprintf("error reading package.json: %v", err))
+		exitCode = 1
 		return
 	}
-	ui.Success(fmt.Sprintf("uninstalled %s", name))
-	pkgJsonPath := "package.json"
-	file, err := os.ReadFile(pkgJsonPath)
+	delete(packageJSON.Dependencies, name)
+	delete(packageJSON.DevDependencies, name)
+	delete(packageJSON.PeerDependencies, name)
+	delete(packageJSON.OptionalDependencies, name)
+	workspaces, err := findWorkspaces(".", packageJSON)
 	if err != nil {
+		ui.Error(fmt.Sprintf("error reading workspaces: %v", err))
+		exitCode = 1
 		return
 	}
-	var packageJSON PackageJSON
-	err = json.Unmarshal(file, &packageJSON)
+	lock := readLockfileOrWarn()
+	tree, results, err := resolveAndInstall(".", rootPackage(packageJSON), lock, workspaces)
 	if err != nil {
+		if len(results) > 0 {
+			displayInstallResults(results, startTime)
+		}
+		ui.Error(err.Error())
+		exitCode = 1
 		return
 	}
-	if _, ok := packageJSON.Dependencies[name]; ok {
-		delete(packageJSON.Dependencies, name)
-		updated, err := json.MarshalIndent(packageJSON, "", "  ")
-		if err == nil {
-			_ = os.WriteFile(pkgJsonPath, updated, 0644)
-			ui.Info("updated package.json")
+	// without a lockfile nothing recorded where name was placed, so it is
+	// removed here unless something else still needs it at the top level
+	if _, needed := tree.root.children[name]; !needed {
+		if err := os.RemoveAll(packageDir); err != nil {
+			ui.Error(fmt.Sprintf("failed to uninstall %s: %v", name, err))
+			exitCode = 1
+			return
 		}
 	}
+	if err := pkgFile.Save(); err != nil {
+		ui.Error(fmt.Sprintf("failed to update package.json: %v", err))
+		exitCode = 1
+		return
+	}
+	ui.Info("updated package.json")
+	if err := linkLocalBinaries(); err != nil {
+		ui.Error(fmt.Sprintf("failed to link binaries: %v", err))
+	}
+	runDependencyScripts(".", results)
+	if lock == nil {
+		lock = newLockfile(packageJSON)
+	}
+	lock.setRoot(packageJSON)
+	lock.setTree(tree)
+	if err := writeLockfile(lock); err != nil {
+		ui.Error(fmt.Sprintf("failed to write %s: %v", LOCKFILE_NAME, err))
+	}
+	for _, result := range results {
+		if result.failed() {
+			displayInstallResults(results, startTime)
+			return
+		}
+	}
+	ui.Success(fmt.Sprintf("uninstalled %s in %v", name, time.Since(startTime).Round(time.Millisecond)))
 }
 func uninstallPackageGlobal(name string) {
     ui.Header(fmt.Sprintf("uninstalling global package %s", name))
     globalDir, err := getGlobalInstallDir()
     if err != nil {
         ui.Error(fmt.Sprintf("failed to determine global directory: %v", err))
+        exitCode = 1
         return
     }
     packageDir := filepath.Join(globalDir, name)
@@ -696,73 +921,175 @@ func uninstallPackageGlobal(name string) {
     err = os.RemoveAll(packageDir)
     if err != nil {
         ui.Error(fmt.Sprintf("failed to uninstall %s: %v", name, err))
+        exitCode = 1
         return
     }
     ui.Success(fmt.Sprintf("uninstalled global package %s", name))
 }
-func updatePackage(name string) {
-	ui.Header(fmt.Sprintf("updating package: %s", name))
+// updatePackages updates the named root dependencies, or all of them, to
+// the newest versions their ranges allow, or with latest to the latest tag
+// even across majors. package.json keeps each range's prefix style and
+// the lockfile is rewritten.
+func updatePackages(names []string, latest bool) {
+	startTime := time.Now()
 	packageJSON, err := readPackageJSON()
 	if err != nil {
 		ui.Error(fmt.Sprintf("error reading package.json: %v", err))
+		exitCode = 1
 		return
 	}
-	if _, ok := packageJSON.Dependencies[name]; !ok {
-		ui.Warning(fmt.Sprintf("package '%s' is not in dependencies", name))
+	workspaces, err := findWorkspaces(".", packageJSON)
+	if err != nil {
+		ui.Error(fmt.Sprintf("error reading workspaces: %v", err))
+		exitCode = 1
 		return
 	}
-	tasks := []InstallTask{{
-		Name:    name,
-		Version: "latest",
-		Dir:     NODE_MODULES_DIR,
-		IsRoot:  true,
-	}}
-	results := installPackagesConcurrently(tasks)
-	for _, result := range results {
-		if result.Error == nil {
-			packageJSON.Dependencies[name] = result.Task.Version
+	root := rootPackage(packageJSON)
+	deps := root.allDependencies()
+	if len(deps) == 0 {
+		ui.Warning("no dependencies found in package.json")
+		return
+	}
+	targets := names
+	for _, name := range names {
+		if _, ok := deps[name]; !ok {
+			ui.Error(fmt.Sprintf("%s is not a dependency in package.json", name))
+			exitCode = 1
+			return
 		}
 	}
-	data, err := json.MarshalIndent(packageJSON, "", "  ")
-	if err == nil {
-		_ = os.WriteFile("package.json", data, 0644)
-		ui.Info("updated package.json")
+	if len(targets) == 0 {
+		for name := range deps {
+			targets = append(targets, name)
+		}
+		sort.Strings(targets)
 	}
-	displayInstallResults(results, time.Now())
-}
-func updateAllPackages() {
-	startTime := time.Now()
-	packageJSON, err := readPackageJSON()
+	kinds := make(map[string]string)
+	for _, name := range targets {
+		kinds[name] = root.dependencyKind(name)
+	}
+	if latest {
+		ui.Header(fmt.Sprintf("updating %d dependencies to their latest versions", len(targets)))
+		for _, name := range targets {
+			realName, rng := parseDependencySpec(name, deps[name])
+			if _, err := parseRange(rng); err != nil {
+				continue
+			}
+			spec := "latest"
+			if realName != name {
+				spec = "npm:" + realName + "@latest"
+			}
+			root.addDependency(name, spec, kinds[name])
+		}
+	} else {
+		ui.Header(fmt.Sprintf("updating %d dependencies within their ranges", len(targets)))
+	}
+	lock := readLockfileOrWarn()
+	seed := lock
+	if lock != nil {
+		seed = lock.forget(names)
+	}
+	tree, results, err := resolveAndInstall(".", root, seed, workspaces)
 	if err != nil {
-		ui.Error(fmt.Sprintf("error reading package.json: %v", err))
+		if len(results) > 0 {
+			displayInstallResults(results, startTime)
+		}
+		ui.Error(err.Error())
+		exitCode = 1
 		return
 	}
-	if len(packageJSON.Dependencies) == 0 {
-		ui.Warning("no dependencies found in package.json")
+	if lock != nil && !anyFailed(results) {
+		tree.removeExtraneous(lock, tree.installable(omittedKinds()))
+	}
+	if err := linkLocalBinaries(); err != nil {
+		ui.Error(fmt.Sprintf("failed to link binaries: %v", err))
+	}
+	runDependencyScripts(".", results)
+	pkgFile, err := loadPackageJSONFile("package.json")
+	if err != nil {
+		ui.Error(fmt.Sprintf("failed to update package.json: %v", err))
+		exitCode = 1
 		return
 	}
-	ui.Header("updating all dependencies to latest versions")
-	tasks := make([]InstallTask, 0, len(packageJSON.Dependencies))
-	for name := range packageJSON.Dependencies {
-		tasks = append(tasks, InstallTask{
-			Name:    name,
-			Version: "latest",
-			Dir:     NODE_MODULES_DIR,
-			IsRoot:  true,
-		})
-	}
-	results := installPackagesConcurrently(tasks)
-	for _, result := range results {
-		if result.Error == nil {
-			packageJSON.Dependencies[result.Task.Name] = result.Task.Version
+	var changes []string
+	for _, name := range targets {
+		node, ok := tree.root.edges[name]
+		if !ok {
+			continue
+		}
+		oldSpec := deps[name]
+		newSpec := updatedSpec(oldSpec, node.pkg.Version)
+		previous := "(none)"
+		if lock != nil {
+			if entry, ok := lock.Packages[lockPath(NODE_MODULES_DIR, name)]; ok {
+				previous = entry.Version
+			}
+		}
+		if newSpec != oldSpec {
+			pkgFile.SetDependency(dependencySection(kinds[name]), name, newSpec)
+		}
+		switch {
+		case previous != node.pkg.Version && newSpec != oldSpec:
+			changes = append(changes, fmt.Sprintf("%s %s → %s (%s → %s)", name, previous, node.pkg.Version, oldSpec, newSpec))
+		case previous != node.pkg.Version:
+			changes = append(changes, fmt.Sprintf("%s %s → %s", name, previous, node.pkg.Version))
+		case newSpec != oldSpec:
+			changes = append(changes, fmt.Sprintf("%s %s → %s", name, oldSpec, newSpec))
 		}
 	}
-	data, err := json.MarshalIndent(packageJSON, "", "  ")
-	if err == nil {
-		_ = os.WriteFile("package.json", data, 0644)
-		ui.Info("updated package.json with latest versions")
+	if err := pkgFile.Save(); err != nil {
+		ui.Error(fmt.Sprintf("failed to update package.json: %v", err))
+		exitCode = 1
+	}
+	if packageJSON, err := readPackageJSON(); err == nil {
+		if lock == nil {
+			lock = newLockfile(packageJSON)
+		}
+		lock.setRoot(packageJSON)
+		lock.setTree(tree)
+		if err := writeLockfile(lock); err != nil {
+			ui.Error(fmt.Sprintf("failed to write %s: %v", LOCKFILE_NAME, err))
+		}
 	}
 	displayInstallResults(results, startTime)
+	if len(changes) == 0 {
+		ui.Info("all dependencies are already up to date")
+		return
+	}
+	ui.Header(fmt.Sprintf("updated %d dependencies", len(changes)))
+	for _, change := range changes {
+		ui.Success(change)
+	}
+}
+// anyFailed reports whether any result fails the install.
+func anyFailed(results []InstallResult) bool {
+	for _, result := range results {
+		if result.failed() {
+			return true
+		}
+	}
+	return false
+}
+// updatedSpec rewrites a range for a newly resolved version in the same
+// style: ^, ~ and >= ranges and exact pins move to the new version, tags and
+// ranges that still match are left alone, and anything else gets
+// save-prefix.
+func updatedSpec(old, resolved string) string {
+	if strings.HasPrefix(old, "npm:") {
+		realName, spec := parseDependencySpec("", old)
+		return "npm:" + realName + "@" + updatedSpec(spec, resolved)
+	}
+	for _, prefix := range []string{"^", "~", ">=", ""} {
+		if rest, ok := strings.CutPrefix(old, prefix); ok {
+			if _, err := parseSemVer(rest); err == nil {
+				return prefix + resolved
+			}
+		}
+	}
+	if _, err := parseRange(old); err != nil || satisfiesRange(resolved, old) {
+		return old
+	}
+	return savePrefix() + resolved
 }
 func installPackagesConcurrently(tasks []InstallTask) []InstallResult {
 	taskChan := make(chan InstallTask, len(tasks))
@@ -795,6 +1122,9 @@ func installPackagesConcurrently(tasks []InstallTask) []InstallResult {
 }
 func processInstallTask(task InstallTask) InstallResult {
     startTime := time.Now()
+    if task.Locked != nil {
+        return installLockedPackage(task, startTime)
+    }
     actualPkgName := task.Name
     if strings.HasPrefix(task.Version, "npm:") {
         parts := strings.Split(task.Version, "@")
@@ -811,58 +1141,58 @@ func processInstallTask(task InstallTask) InstallResult {
             Duration: time.Since(startTime),
         }
     }
-    version := task.Version
-    if version == "latest" {
-        version = registryData.DistTags["latest"]
-    } else if _, err := strconv.Atoi(version); err == nil {
-        var matchingVersions []string
-        for v := range registryData.Versions {
-            if strings.HasPrefix(v, version+".") {
-                matchingVersions = append(matchingVersions, v)
-            }
-        }
-        if len(matchingVersions) > 0 {
-            sort.Slice(matchingVersions, func(i, j int) bool {
-                return compareVersions(matchingVersions[i], matchingVersions[j]) > 0
-            })
-            version = matchingVersions[0]
-        } else {
-            return InstallResult{
-                Task:     task,
-                Error:    fmt.Errorf("no matching version found for %s (tried %s)", task.Version, strings.Join(getAllVersions(registryData.Versions), ", ")),
-                Duration: time.Since(startTime),
-            }
+    resolvedVersion, err := resolveVersion(registryData, task.Version)
+    if err != nil {
+        return InstallResult{
+            Task:     task,
+            Error:    err,
+            Duration: time.Since(startTime),
         }
     }
-    var packageData Package
-    var resolvedVersion string
-    if pkg, exists := registryData.Versions[version]; exists {
-        packageData = pkg
-        resolvedVersion = version
-    } else {
-        versions := make([]string, 0, len(registryData.Versions))
-        for v := range registryData.Versions {
-            versions = append(versions, v)
-        }
-        sort.Slice(versions, func(i, j int) bool {
-            return compareVersions(versions[i], versions[j]) > 0
-        })
-        for _, v := range versions {
-            if versionMatches(v, version) {
-                packageData = registryData.Versions[v]
-                resolvedVersion = v
-                break
-            }
-        }
-        if resolvedVersion == "" {
-            return InstallResult{
-                Task:     task,
-                Error:    fmt.Errorf("no matching version found for %s (tried %s)", version, strings.Join(versions, ", ")),
-                Duration: time.Since(startTime),
-            }
+    resolved := lockedFromManifest(registryData.Versions[resolvedVersion])
+    if actualPkgName != task.Name {
+        resolved.Name = actualPkgName
+    }
+    task.Locked = resolved
+    return installLockedPackage(task, startTime)
+}
+// resolveVersion picks the version a spec refers to: a dist-tag, or else the
+// highest version satisfying the range, preferring the "latest" tag when it
+// is in range the way npm does.
+func resolveVersion(registryData *RegistryResponse, spec string) (string, error) {
+    spec = strings.TrimSpace(spec)
+    if tagged, ok := registryData.DistTags[spec]; ok {
+        if _, exists := registryData.Versions[tagged]; exists {
+            return tagged, nil
         }
     }
+    r, err := parseRange(spec)
+    if err != nil {
+        return "", fmt.Errorf("%s: %v", registryData.Name, err)
+    }
+    latest := registryData.DistTags["latest"]
+    if _, exists := registryData.Versions[latest]; exists && satisfiesRange(latest, spec) {
+        return latest, nil
+    }
+    versions := make([]string, 0, len(registryData.Versions))
+    for v := range registryData.Versions {
+        versions = append(versions, v)
+    }
+    if best := maxSatisfying(versions, r); best != "" {
+        return best, nil
+    }
+    return "", fmt.Errorf("no version of %s satisfies %s (latest is %s)", registryData.Name, spec, latest)
+}
+func installLockedPackage(task InstallTask, startTime time.Time) InstallResult {
+    locked := task.Locked
     packageDir := filepath.Join(task.Dir, task.Name)
+    if err := locked.platformError(); err != nil {
+        return InstallResult{
+            Task:     task,
+            Error:    err,
+            Duration: time.Since(startTime),
+        }
+    }
     if err := os.MkdirAll(task.Dir, 0755); err != nil {
         return InstallResult{
             Task:     task,
@@ -871,15 +1201,23 @@ func processInstallTask(task InstallTask) InstallResult {
         }
     }
     if existingVersion, err := getInstalledVersion(packageDir); err == nil {
-        if existingVersion == resolvedVersion {
+        if existingVersion == locked.Version {
             return InstallResult{
                 Task:     task,
                 Error:    nil,
                 Duration: time.Since(startTime),
+                Resolved: locked,
             }
         }
     }
-    size, err := downloadAndExtractPackageEnhanced(packageData.Dist.Tarball, packageDir, task.Name)
+    if locked.Resolved == "" {
+        return InstallResult{
+            Task:     task,
+            Error:    fmt.Errorf("no tarball recorded for %s@%s", task.Name, locked.Version),
+            Duration: time.Since(startTime),
+        }
+    }
+    size, err := installFromStore(locked, packageDir, task.Name)
     if err != nil {
         return InstallResult{
             Task:     task,
@@ -892,205 +1230,16 @@ func processInstallTask(task InstallTask) InstallResult {
         Error:    nil,
         Size:     size,
         Duration: time.Since(startTime),
+        Resolved: locked,
+        Extracted: true,
     }
 }
-func getAllVersions(versions map[string]Package) []string {
-    result := make([]string, 0, len(versions))
-    for v := range versions {
-        result = append(result, v)
-    }
-    return result
-}
-func parseVersionConstraint(constraint string) (string, string, error) {
-    if constraint == "" || constraint == "*" {
-        return "", "", nil
-    }
-    if !strings.ContainsAny(constraint, "^~><= ") {
-        return "=", constraint, nil
-    }
-    if strings.HasPrefix(constraint, "^") {
-        return "^", strings.TrimPrefix(constraint, "^"), nil
-    }
-    if strings.HasPrefix(constraint, "~") {
-        return "~", strings.TrimPrefix(constraint, "~"), nil
-    }
-    ops := []string{">=", "<=", ">", "<", "="}
-    for _, op := range ops {
-        if strings.HasPrefix(constraint, op) {
-            return op, strings.TrimPrefix(constraint, op), nil
-        }
-    }
-    if strings.Contains(constraint, " - ") {
-        parts := strings.Split(constraint, " - ")
-        if len(parts) == 2 {
-            return "-", fmt.Sprintf("%s %s", parts[0], parts[1]), nil
-        }
-    }
-    if strings.Contains(constraint, "x") {
-        return "x", constraint, nil
-    }
-    return "", "", fmt.Errorf("unsupported version constraint: %s", constraint)
-}
-func satisfiesVersion(version, constraint string) bool {
-    if constraint == "" || constraint == "*" {
-        return true
-    }
-    op, ver, err := parseVersionConstraint(constraint)
+func shasumToIntegrity(shasum string) string {
+    raw, err := hex.DecodeString(shasum)
     if err != nil {
-        return false
-    }
-    switch op {
-    case "":
-        return version == ver
-    case "=":
-        return version == ver
-    case "^":
-        return satisfiesCaret(version, ver)
-    case "~":
-        return satisfiesTilde(version, ver)
-    case ">":
-        return compareVersions(version, ver) > 0
-    case ">=":
-        return compareVersions(version, ver) >= 0
-    case "<":
-        return compareVersions(version, ver) < 0
-    case "<=":
-        return compareVersions(version, ver) <= 0
-    case "-":
-        parts := strings.Split(ver, " ")
-        if len(parts) != 2 {
-            return false
-        }
-        return compareVersions(version, parts[0]) >= 0 &&
-            compareVersions(version, parts[1]) <= 0
-    case "x":
-        pattern := strings.Replace(ver, "x", `\d+`, -1)
-        pattern = strings.Replace(pattern, ".", `\.`, -1)
-        pattern = "^" + pattern + "$"
-        matched, _ := regexp.MatchString(pattern, version)
-        return matched
-    }
-    return false
-}
-func satisfiesCaret(version, constraint string) bool {
-    cv := strings.Split(constraint, ".")
-    vv := strings.Split(version, ".")
-    if len(cv) == 0 || len(vv) == 0 {
-        return false
-    }
-    if cv[0] == "0" {
-        if len(cv) > 1 && len(vv) > 1 {
-            if cv[1] != vv[1] {
-                return false
-            }
-        }
-        if len(cv) > 2 && len(vv) > 2 {
-            if cv[2] != vv[2] {
-                return false
-            }
-        }
-        return true
-    }
-    if cv[0] != vv[0] {
-        return false
-    }
-    return compareVersions(version, constraint) >= 0
-}
-func satisfiesTilde(version, constraint string) bool {
-    cv := strings.Split(constraint, ".")
-    vv := strings.Split(version, ".")
-    if len(cv) == 0 || len(vv) == 0 {
-        return false
-    }
-    if len(cv) >= 3 && len(vv) >= 3 {
-        if cv[0] != vv[0] || cv[1] != vv[1] {
-            return false
-        }
-        return compareVersions(version, constraint) >= 0
+        return ""
     }
-    if len(cv) >= 2 && len(vv) >= 2 {
-        if cv[0] != vv[0] {
-            return false
-        }
-        return compareVersions(version, constraint) >= 0
-    }
-    return cv[0] == vv[0]
-}
-func versionMatches(version, constraint string) bool {
-	if _, err := strconv.Atoi(constraint); err == nil {
-        return strings.HasPrefix(version, constraint+".")
-    }
-    if strings.HasPrefix(constraint, "npm:") {
-        parts := strings.Split(constraint, "@")
-        if len(parts) >= 2 {
-            constraint = parts[len(parts)-1]
-        }
-    }
-    orConstraints := strings.Split(constraint, "||")
-    for _, c := range orConstraints {
-        c = strings.TrimSpace(c)
-        if satisfiesVersion(version, c) {
-            return true
-        }
-    }
-    return false
-}
-func compareVersions(v1, v2 string) int {
-    parts1 := strings.Split(strings.TrimPrefix(v1, "v"), ".")
-    parts2 := strings.Split(strings.TrimPrefix(v2, "v"), ".")
-    prerelease1 := ""
-    prerelease2 := ""
-    if len(parts1) > 0 {
-        if idx := strings.Index(parts1[len(parts1)-1], "-"); idx != -1 {
-            prerelease1 = parts1[len(parts1)-1][idx+1:]
-            parts1[len(parts1)-1] = parts1[len(parts1)-1][:idx]
-        }
-    }
-    if len(parts2) > 0 {
-        if idx := strings.Index(parts2[len(parts2)-1], "-"); idx != -1 {
-            prerelease2 = parts2[len(parts2)-1][idx+1:]
-            parts2[len(parts2)-1] = parts2[len(parts2)-1][:idx]
-        }
-    }
-    maxLen := max(len(parts1), len(parts2))
-    for i := 0; i < maxLen; i++ {
-        var p1, p2 string
-        if i < len(parts1) {
-            p1 = parts1[i]
-        }
-        if i < len(parts2) {
-            p2 = parts2[i]
-        }
-        n1, err1 := strconv.Atoi(p1)
-        n2, err2 := strconv.Atoi(p2)
-        if err1 == nil && err2 == nil {
-            if n1 < n2 {
-                return -1
-            } else if n1 > n2 {
-                return 1
-            }
-            continue
-        }
-        if p1 < p2 {
-            return -1
-        } else if p1 > p2 {
-            return 1
-        }
-    }
-    if prerelease1 != "" || prerelease2 != "" {
-        if prerelease1 == "" {
-            return 1
-        }
-        if prerelease2 == "" {
-            return -1
-        }
-        if prerelease1 < prerelease2 {
-            return -1
-        } else if prerelease1 > prerelease2 {
-            return 1
-        }
-    }
-    return 0
+    return "sha1-" + base64.StdEncoding.EncodeToString(raw)
 }
 func getInstalledVersion(packageDir string) (string, error) {
     packageJSONPath := filepath.Join(packageDir, "package.json")
@@ -1106,17 +1255,42 @@ func getInstalledVersion(packageDir string) (string, error) {
     }
     return pkg.Version, nil
 }
-func downloadAndExtractPackageEnhanced(tarballURL, destDir, packageName string) (int64, error) {
-	resp, err := httpClient.Get(tarballURL)
+func downloadAndExtractPackageEnhanced(tarballURL, destDir, packageName, integrity string) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(destDir), 0755); err != nil {
+		return 0, err
+	}
+	stagingDir, err := os.MkdirTemp(filepath.Dir(destDir), ".gopm-")
 	if err != nil {
 		return 0, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("failed to download: %s", resp.Status)
+	defer os.RemoveAll(stagingDir)
+	size, err := fetchTarball(tarballURL, stagingDir, packageName, integrity)
+	if err != nil {
+		return 0, err
 	}
+	if err := replacePackageDir(stagingDir, destDir); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+// fetchTarball downloads and extracts a tarball into an empty directory,
+// verifying it against integrity when one is known.
+func fetchTarball(tarballURL, destDir, packageName, integrity string) (int64, error) {
+	var verifier *integrityVerifier
+	if integrity != "" {
+		v, err := newIntegrityVerifier(integrity)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", packageName, err)
+		}
+		verifier = v
+	}
+	body, size, commit, err := openTarball(tarballURL, integrity)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
 	bar := progressbar.NewOptions64(
-		resp.ContentLength,
+		size,
 		progressbar.OptionSetDescription(fmt.Sprintf(" %s", packageName)),
 		progressbar.OptionSetWidth(30),
 		progressbar.OptionShowBytes(true),
@@ -1127,47 +1301,121 @@ func downloadAndExtractPackageEnhanced(tarballURL, destDir, packageName string)
 			BarEnd:        "▌",
 		}),
 	)
-	if err := os.MkdirAll(destDir, 0755); err != nil {
-		return 0, err
+	var reader io.Reader = io.TeeReader(body, bar)
+	if verifier != nil {
+		reader = io.TeeReader(reader, verifier)
 	}
-	reader := io.TeeReader(resp.Body, bar)
 	err = extractTarGz(reader, destDir)
+	if err == nil {
+		_, err = io.Copy(io.Discard, reader)
+	}
 	bar.Finish()
-	return resp.ContentLength, err
+	if err == nil && verifier != nil {
+		err = verifier.Verify(packageName)
+	}
+	if err != nil {
+		cached, ok := body.(*cachedTarball)
+		if !ok {
+			return 0, err
+		}
+		cached.evict()
+		if isOffline() {
+			return 0, fmt.Errorf("%v (removed the corrupt tarball from the cache)", err)
+		}
+		ui.Warning(fmt.Sprintf("cached tarball for %s is corrupt, fetching it again: %v", packageName, err))
+		if err := os.RemoveAll(destDir); err != nil {
+			return 0, err
+		}
+		if err := os.MkdirAll(destDir, 0755); err != nil {
+			return 0, err
+		}
+		return fetchTarball(tarballURL, destDir, packageName, integrity)
+	}
+	if verifier != nil {
+		commit()
+	}
+	return size, nil
+}
+// replacePackageDir moves a freshly extracted package into place, keeping any
+// nested node_modules that dependencies were already installed into.
+func replacePackageDir(stagingDir, destDir string) error {
+	if err := os.Rename(stagingDir, destDir); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	existing, err := os.ReadDir(destDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range existing {
+		if entry.Name() == NODE_MODULES_DIR {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(destDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	staged, err := os.ReadDir(stagingDir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range staged {
+		if entry.Name() == NODE_MODULES_DIR {
+			continue
+		}
+		if err := os.Rename(filepath.Join(stagingDir, entry.Name()), filepath.Join(destDir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 func displayInstallResults(results []InstallResult, startTime time.Time) {
 	successful := 0
 	failed := 0
 	totalSize := int64(0)
+	skipped := 0
 	for _, result := range results {
-		if result.Error != nil {
+		if result.failed() {
 			ui.Error(fmt.Sprintf("%s@%s: %v", result.Task.Name, result.Task.Version, result.Error))
 			failed++
+		} else if result.Error != nil {
+			ui.Warning(fmt.Sprintf("skipped optional %s@%s: %v", result.Task.Name, result.Task.Version, result.Error))
+			skipped++
 		} else {
 			ui.Success(fmt.Sprintf("%s@%s installed in %v", result.Task.Name, result.Task.Version, result.Duration))
 			successful++
 			totalSize += result.Size
 		}
 	}
+	if failed > 0 {
+		exitCode = 1
+	}
 	totalTime := time.Since(startTime)
 	ui.Header("installation summary")
-	ui.Info(fmt.Sprintf("✓ %d successful, ✗ %d failed", successful, failed))
+	if skipped > 0 {
+		ui.Info(fmt.Sprintf("✓ %d successful, ✗ %d failed, %d optional skipped", successful, failed, skipped))
+	} else {
+		ui.Info(fmt.Sprintf("✓ %d successful, ✗ %d failed", successful, failed))
+	}
 	ui.Info(fmt.Sprintf(" total size: %s", formatBytes(totalSize)))
 	ui.Info(fmt.Sprintf(" total time: %v", totalTime))
 	ui.Info(fmt.Sprintf(" average speed: %s/s", formatBytes(int64(float64(totalSize)/totalTime.Seconds()))))
+	if retries := getRetries(); len(retries) > 0 {
+		ui.Warning(fmt.Sprintf(" retries: %d", len(retries)))
+		for _, retry := range retries {
+			fmt.Printf("  • %s (attempt %d): %s\n", retry.URL, retry.Attempt, retry.Reason)
+		}
+	}
 }
 func getPackageFromRegistry(name string) (*RegistryResponse, error) {
-	url := fmt.Sprintf("%s/%s", NPM_REGISTRY_URL, name)
-	resp, err := httpClient.Get(url)
+	data, err := fetchPackument(name, packumentURL(name))
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("package not found: %s", name)
-	}
 	var registryData RegistryResponse
-	if err := json.NewDecoder(resp.Body).Decode(&registryData); err != nil {
+	if err := json.Unmarshal(data, &registryData); err != nil {
 		return nil, err
 	}
 	return &registryData, nil
@@ -1237,6 +1485,7 @@ func initPackage() {
 	file, err := os.Create("package.json")
 	if err != nil {
 		ui.Error(fmt.Sprintf("error creating package.json: %v", err))
+		exitCode = 1
 		return
 	}
 	defer file.Close()
@@ -1244,6 +1493,7 @@ func initPackage() {
 	encoder.SetIndent("", "  ")
 	if err := encoder.Encode(packageJSON); err != nil {
 		ui.Error(fmt.Sprintf("error writing package.json: %v", err))
+		exitCode = 1
 		return
 	}
 	ui.Success("created package.json")
@@ -1253,6 +1503,7 @@ func showPackageInfo(name string) {
 	registryData, err := getPackageFromRegistry(name)
 	if err != nil {
 		ui.Error(fmt.Sprintf("error fetching package info: %v", err))
+		exitCode = 1
 		return
 	}
 	latest := registryData.DistTags["latest"]
@@ -1280,13 +1531,25 @@ func showPackageInfo(name string) {
 }
 func searchPackages(query string) {
 	ui.Header(fmt.Sprintf("searching for: %s", query))
-	url := fmt.Sprintf("https://registry.npmjs.org/-/v1/search?text=%s&size=20", query)
-	resp, err := httpClient.Get(url)
+	searchURL := fmt.Sprintf("%s/-/v1/search?text=%s&size=20", getConfig().registryFor(query), url.QueryEscape(query))
+	req, err := newRegistryRequest(searchURL)
+	if err != nil {
+		ui.Error(fmt.Sprintf("error searching packages: %v", err))
+		exitCode = 1
+		return
+	}
+	resp, err := registryDo(req)
 	if err != nil {
 		ui.Error(fmt.Sprintf("error searching packages: %v", err))
+		exitCode = 1
 		return
 	}
 	defer resp.Body.Close()
+	if err := checkRegistryResponse(resp, query); err != nil {
+		ui.Error(fmt.Sprintf("error searching packages: %v", err))
+		exitCode = 1
+		return
+	}
 	var searchResult struct {
 		Objects []struct {
 			Package struct {
@@ -1305,6 +1568,7 @@ func searchPackages(query string) {
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&searchResult); err != nil {
 		ui.Error(fmt.Sprintf("error parsing search results: %v", err))
+		exitCode = 1
 		return
 	}
 	ui.Info(fmt.Sprintf("found %d packages", len(searchResult.Objects)))
@@ -1333,6 +1597,7 @@ func listPackages() {
 	entries, err := os.ReadDir(nodeModulesDir)
 	if err != nil {
 		ui.Error(fmt.Sprintf("error reading node_modules: %v", err))
+		exitCode = 1
 		return
 	}
 	packages := make([]string, 0)
@@ -1357,6 +1622,7 @@ func listGlobalPackages() {
     globalDir, err := getGlobalInstallDir()
     if err != nil {
         ui.Error(fmt.Sprintf("failed to determine global directory: %v", err))
+        exitCode = 1
         return
     }
     if _, err := os.Stat(globalDir); os.IsNotExist(err) {
@@ -1366,6 +1632,7 @@ func listGlobalPackages() {
     entries, err := os.ReadDir(globalDir)
     if err != nil {
         ui.Error(fmt.Sprintf("error reading global packages: %v", err))
+        exitCode = 1
         return
     }
     packages := make([]string, 0)
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// OutdatedPackage is a row of gopm outdated, and its --json form.
+type OutdatedPackage struct {
+	Name     string `json:"-"`
+	Current  string `json:"current,omitempty"`
+	Wanted   string `json:"wanted"`
+	Latest   string `json:"latest"`
+	Type     string `json:"type"`
+	Location string `json:"location"`
+	// Repository is the repository URL of the latest version.
+	Repository string `json:"-"`
+}
+
+// outdatedCommand compares every root dependency, or just the ones named,
+// with the newest version its range allows and the latest tag. It exits
+// non-zero when anything is behind, so CI can flag it.
+func outdatedCommand(names []string) {
+	pkgJSON, err := readPackageJSON()
+	if err != nil {
+		ui.Error(fmt.Sprintf("error reading package.json: %v", err))
+		exitCode = 1
+		return
+	}
+	root := rootPackage(pkgJSON)
+	deps, err := namedDependencies(root, names)
+	if err != nil {
+		ui.Error(err.Error())
+		exitCode = 1
+		return
+	}
+	outdated, errs := findOutdated(root, deps)
+	for _, err := range errs {
+		if hasFlag("json") {
+			fmt.Fprintln(os.Stderr, err)
+		} else {
+			ui.Error(err.Error())
+		}
+		exitCode = 1
+	}
+	if len(outdated) > 0 {
+		exitCode = 1
+	}
+	if hasFlag("json") {
+		byName := make(map[string]OutdatedPackage, len(outdated))
+		for _, pkg := range outdated {
+			byName[pkg.Name] = pkg
+		}
+		data, _ := json.MarshalIndent(byName, "", "  ")
+		fmt.Println(string(data))
+		return
+	}
+	if len(outdated) == 0 {
+		ui.Success("all dependencies are up to date")
+		return
+	}
+	printOutdatedTable(outdated)
+}
+
+// namedDependencies returns the root dependencies with the given names, or
+// all of them when there are none.
+func namedDependencies(root *LockedPackage, names []string) (map[string]string, error) {
+	deps := root.allDependencies()
+	if len(names) == 0 {
+		return deps, nil
+	}
+	selected := make(map[string]string)
+	for _, name := range names {
+		spec, ok := deps[name]
+		if !ok {
+			return nil, fmt.Errorf("%s is not a dependency in package.json", name)
+		}
+		selected[name] = spec
+	}
+	return selected, nil
+}
+
+// findOutdated fetches the packument of each dependency concurrently and
+// returns, sorted by name, the ones whose installed version is missing or
+// differs from wanted or latest.
+func findOutdated(root *LockedPackage, deps map[string]string) ([]OutdatedPackage, []error) {
+	var (
+		outdated []OutdatedPackage
+		errs     []error
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+	)
+	names := make(chan string, len(deps))
+	for name := range deps {
+		names <- name
+	}
+	close(names)
+	for i := 0; i < min(MAX_CONCURRENT, len(deps)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				pkg, err := checkOutdated(name, deps[name], root.dependencyKind(name))
+				mu.Lock()
+				if err != nil {
+					errs = append(errs, err)
+				} else if pkg != nil {
+					outdated = append(outdated, *pkg)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	sort.Slice(outdated, func(i, j int) bool {
+		return outdated[i].Name < outdated[j].Name
+	})
+	return outdated, errs
+}
+
+// checkOutdated returns the row for one dependency, or nil when it is
+// current or its spec is not a registry range (a git URL, a file path).
+func checkOutdated(name, spec, kind string) (*OutdatedPackage, error) {
+	realName, rng := parseDependencySpec(name, spec)
+	if strings.ContainsAny(rng, ":/") {
+		return nil, nil
+	}
+	registryData, err := getPackageFromRegistry(realName)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	wanted, err := resolveVersion(registryData, rng)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	location := lockPath(NODE_MODULES_DIR, name)
+	current, _ := getInstalledVersion(filepath.FromSlash(location))
+	latest := registryData.DistTags["latest"]
+	if current == wanted && current == latest {
+		return nil, nil
+	}
+	return &OutdatedPackage{
+		Name:       name,
+		Current:    current,
+		Wanted:     wanted,
+		Latest:     latest,
+		Type:       dependencySection(kind),
+		Location:   location,
+		Repository: registryData.Versions[latest].Repository.URL,
+	}, nil
+}
+
+// printOutdatedTable prints the rows the way npm does: the name in red when
+// an update within the range is waiting, yellow when only a newer major
+// outside it is.
+func printOutdatedTable(outdated []OutdatedPackage) {
+	header := []string{"Package", "Current", "Wanted", "Latest", "Type", "Location"}
+	rows := [][]string{header}
+	for _, pkg := range outdated {
+		current := pkg.Current
+		if current == "" {
+			current = "MISSING"
+		}
+		rows = append(rows, []string{pkg.Name, current, pkg.Wanted, pkg.Latest, pkg.Type, pkg.Location})
+	}
+	widths := make([]int, len(header))
+	for _, row := range rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], len(cell))
+		}
+	}
+	for r, row := range rows {
+		var line strings.Builder
+		for i, cell := range row {
+			padded := cell
+			if i < len(row)-1 {
+				padded += strings.Repeat(" ", widths[i]-len(cell)+2)
+			}
+			switch {
+			case r == 0:
+				padded = ui.bold.Sprint(padded)
+			case i == 0 && outdated[r-1].Current != outdated[r-1].Wanted:
+				padded = ui.red.Sprint(padded)
+			case i == 0:
+				padded = ui.yellow.Sprint(padded)
+			case i == 2:
+				padded = ui.green.Sprint(padded)
+			case i == 3:
+				padded = ui.magenta.Sprint(padded)
+			}
+			line.WriteString(padded)
+		}
+		fmt.Println(line.String())
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// PeerMeta is an entry of peerDependenciesMeta. Optional peers are never
+// installed for the package that declares them, only checked when present.
+type PeerMeta struct {
+	Optional bool `json:"optional,omitempty"`
+}
+
+// peerConflict is a peer dependency that the package its dependent sees
+// under that name does not satisfy.
+type peerConflict struct {
+	dependent *depNode
+	name      string
+	spec      string
+	installed *depNode
+}
+
+func (c peerConflict) String() string {
+	return fmt.Sprintf("%s@%s wants peer %s@%s, but %s@%s is installed at %s",
+		c.dependent.name, c.dependent.pkg.Version, c.name, c.spec,
+		c.name, c.installed.pkg.Version, c.installed.path)
+}
+
+// checkPeers finds every peer dependency, optional ones included, that is
+// present but does not match the range its dependent asks for.
+func (r *resolver) checkPeers() []peerConflict {
+	if r.legacyPeers {
+		return nil
+	}
+	var conflicts []peerConflict
+	r.tree.walk(func(node *depNode) {
+		names := make([]string, 0, len(node.pkg.PeerDependencies))
+		for name := range node.pkg.PeerDependencies {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			spec := node.pkg.PeerDependencies[name]
+			edge := depEdge{name: name, spec: spec, kind: DEP_PEER}
+			installed := r.lookup(edge.from(node), name)
+			if installed == nil || installed == node {
+				continue
+			}
+			if realName, rng := parseDependencySpec(name, spec); !nodeSatisfies(installed, realName, rng) {
+				conflicts = append(conflicts, peerConflict{dependent: node, name: name, spec: spec, installed: installed})
+			}
+		}
+	})
+	return conflicts
+}
+
+// requiredBy lists who else depends on the installed package, with the
+// range each of them asks for.
+func (c peerConflict) requiredBy(tree *depTree) []string {
+	var users []string
+	visit := func(node *depNode) {
+		if node == c.dependent || node.edges[c.name] != c.installed {
+			return
+		}
+		spec := node.pkg.allDependencies()[c.name]
+		if node == tree.root {
+			users = append(users, fmt.Sprintf("the root project (%s)", spec))
+		} else {
+			users = append(users, fmt.Sprintf("%s@%s (%s)", node.name, node.pkg.Version, spec))
+		}
+	}
+	visit(tree.root)
+	tree.walk(visit)
+	return users
+}
+
+// reportPeerConflicts explains each conflict. With --strict-peer-deps the
+// caller aborts the install; otherwise the conflicting versions are kept.
+func (r *resolver) reportPeerConflicts(conflicts []peerConflict) {
+	if len(conflicts) == 0 {
+		return
+	}
+	strict := boolOption("strict-peer-deps", false)
+	if strict {
+		ui.Error(fmt.Sprintf("%d peer dependency conflicts:", len(conflicts)))
+	} else {
+		ui.Warning(fmt.Sprintf("%d peer dependency conflicts:", len(conflicts)))
+	}
+	for _, c := range conflicts {
+		fmt.Printf("  • %s\n", c)
+		for _, user := range c.requiredBy(r.tree) {
+			fmt.Printf("      required by %s\n", user)
+		}
+	}
+	if !strict {
+		ui.Info("installing anyway; use --strict-peer-deps to fail on conflicts, or --legacy-peer-deps to ignore peer dependencies")
+	}
+}
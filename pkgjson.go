@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+var DEPENDENCY_SECTIONS = []string{"dependencies", "devDependencies", "optionalDependencies", "peerDependencies"}
+
+// dependencySection is the package.json section a dependency kind is
+// listed in.
+func dependencySection(kind string) string {
+	if kind == DEP_PROD {
+		return "dependencies"
+	}
+	return kind + "Dependencies"
+}
+
+// PackageJSONFile edits a package.json in place. Only the fields that are
+// changed are re-encoded; every other field keeps its original bytes, and
+// key order, indentation, line endings and the trailing newline survive.
+// A file written on one line stays on one line, with its own spacing.
+type PackageJSONFile struct {
+	path     string
+	keys     []string
+	fields   map[string]json.RawMessage
+	indent   string
+	newline  string
+	trailing bool
+	compact  bool
+	pad      string
+	colon    string
+	comma    string
+}
+
+var (
+	compactLayoutRe = regexp.MustCompile(`^\s*\{(\s*)"(?:[^"\\]|\\.)*"(\s*:\s*)`)
+	compactCommaRe  = regexp.MustCompile(`^\s*(,\s*)`)
+)
+
+// dependencyList is a dependency section decoded with its key order.
+type dependencyList struct {
+	names []string
+	specs map[string]string
+}
+
+func loadPackageJSONFile(path string) (*PackageJSONFile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &PackageJSONFile{
+		path:     path,
+		fields:   make(map[string]json.RawMessage),
+		indent:   detectIndent(data),
+		newline:  "\n",
+		trailing: bytes.HasSuffix(data, []byte("\n")),
+	}
+	if bytes.Contains(data, []byte("\r\n")) {
+		f.newline = "\r\n"
+	}
+	keys, err := decodeObjectKeys(data, func(key string, raw json.RawMessage) {
+		f.fields[key] = raw
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	f.keys = keys
+	if !bytes.Contains(bytes.TrimSpace(data), []byte("\n")) {
+		f.detectCompactLayout(data)
+	}
+	return f, nil
+}
+
+// detectCompactLayout records the spacing of a one-line file: inside the
+// braces, around colons and after commas.
+func (f *PackageJSONFile) detectCompactLayout(data []byte) {
+	f.compact = true
+	f.pad, f.colon, f.comma = "", ":", ","
+	m := compactLayoutRe.FindSubmatch(data)
+	if m == nil {
+		return
+	}
+	f.pad, f.colon = string(m[1]), string(m[2])
+	dec := json.NewDecoder(bytes.NewReader(data))
+	var raw json.RawMessage
+	if _, err := dec.Token(); err != nil {
+		return
+	}
+	if _, err := dec.Token(); err != nil {
+		return
+	}
+	if err := dec.Decode(&raw); err != nil {
+		return
+	}
+	if m := compactCommaRe.FindSubmatch(data[dec.InputOffset():]); m != nil {
+		f.comma = string(m[1])
+	}
+}
+
+// decodeObjectKeys walks the top level of a JSON object, handing each value
+// to fn undecoded, and returns the keys in document order.
+func decodeObjectKeys(data []byte, fn func(string, json.RawMessage)) ([]string, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("expected a JSON object")
+	}
+	var keys []string
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := tok.(string)
+		if !ok {
+			return nil, fmt.Errorf("expected an object key")
+		}
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, err
+		}
+		if _, seen := indexOf(keys, key); !seen {
+			keys = append(keys, key)
+		}
+		fn(key, raw)
+	}
+	return keys, nil
+}
+
+func indexOf(list []string, s string) (int, bool) {
+	for i, item := range list {
+		if item == s {
+			return i, true
+		}
+	}
+	return -1, false
+}
+
+// detectIndent returns the whitespace in front of the first key, which is
+// how npm decides between two spaces, four spaces and tabs.
+func detectIndent(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && trimmed != "\r" {
+			if indent := line[:len(line)-len(trimmed)]; indent != "" {
+				return indent
+			}
+			break
+		}
+	}
+	return "  "
+}
+
+// Dependencies returns a dependency section in its original order.
+func (f *PackageJSONFile) Dependencies(section string) dependencyList {
+	list := dependencyList{specs: make(map[string]string)}
+	raw, ok := f.fields[section]
+	if !ok {
+		return list
+	}
+	list.names, _ = decodeObjectKeys(raw, func(name string, value json.RawMessage) {
+		var spec string
+		json.Unmarshal(value, &spec)
+		list.specs[name] = spec
+	})
+	return list
+}
+
+// SetDependency adds or updates name in section. A new entry goes in front
+// of the first name that sorts after it, as npm places it in a sorted
+// section; existing ones keep their place.
+func (f *PackageJSONFile) SetDependency(section, name, spec string) {
+	list := f.Dependencies(section)
+	if _, exists := list.specs[name]; !exists {
+		i := 0
+		for i < len(list.names) && list.names[i] < name {
+			i++
+		}
+		list.names = append(list.names[:i], append([]string{name}, list.names[i:]...)...)
+	}
+	list.specs[name] = spec
+	f.setDependencies(section, list)
+}
+
+// RemoveDependency deletes name from section and reports whether it was
+// there. An emptied section is kept, as npm does.
+func (f *PackageJSONFile) RemoveDependency(section, name string) bool {
+	list := f.Dependencies(section)
+	i, ok := indexOf(list.names, name)
+	if !ok {
+		return false
+	}
+	list.names = append(list.names[:i], list.names[i+1:]...)
+	delete(list.specs, name)
+	f.setDependencies(section, list)
+	return true
+}
+
+func (f *PackageJSONFile) setDependencies(section string, list dependencyList) {
+	var buf strings.Builder
+	if f.compact {
+		entries := make([]string, len(list.names))
+		for i, name := range list.names {
+			entries[i] = encodeJSONString(name) + f.colon + encodeJSONString(list.specs[name])
+		}
+		if len(entries) == 0 {
+			buf.WriteString("{}")
+		} else {
+			buf.WriteString("{" + f.pad + strings.Join(entries, f.comma) + f.pad + "}")
+		}
+	} else if len(list.names) == 0 {
+		buf.WriteString("{}")
+	} else {
+		buf.WriteString("{")
+		for i, name := range list.names {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(f.newline + f.indent + f.indent)
+			buf.WriteString(encodeJSONString(name) + ": " + encodeJSONString(list.specs[name]))
+		}
+		buf.WriteString(f.newline + f.indent + "}")
+	}
+	if _, exists := f.fields[section]; !exists {
+		f.keys = append(f.keys, section)
+	}
+	f.fields[section] = json.RawMessage(buf.String())
+}
+
+// encodeJSONString quotes s without the HTML escaping json.Marshal applies,
+// so ranges like ">=1 <2" stay readable.
+func encodeJSONString(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+func (f *PackageJSONFile) Save() error {
+	var buf strings.Builder
+	buf.WriteString("{")
+	if f.compact {
+		entries := make([]string, len(f.keys))
+		for i, key := range f.keys {
+			entries[i] = encodeJSONString(key) + f.colon + string(f.fields[key])
+		}
+		if len(entries) > 0 {
+			buf.WriteString(f.pad + strings.Join(entries, f.comma) + f.pad)
+		}
+	} else {
+		for i, key := range f.keys {
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(f.newline + f.indent + encodeJSONString(key) + ": ")
+			buf.Write(f.fields[key])
+		}
+		if len(f.keys) > 0 {
+			buf.WriteString(f.newline)
+		}
+	}
+	buf.WriteString("}")
+	if f.trailing {
+		buf.WriteString(f.newline)
+	}
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(f.path, []byte(buf.String()), info.Mode().Perm())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func editPackageJSON(t *testing.T, original string, edit func(*PackageJSONFile)) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "package.json")
+	if err := os.WriteFile(path, []byte(original), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f, err := loadPackageJSONFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit(f)
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestSetDependencyKeepsHandOrder(t *testing.T) {
+	original := "{\n  \"dependencies\": {\n    \"zod\": \"^3.0.0\",\n    \"axios\": \"^1.0.0\"\n  }\n}\n"
+	got := editPackageJSON(t, original, func(f *PackageJSONFile) {
+		f.SetDependency("dependencies", "lodash", "^4.0.0")
+	})
+	want := "{\n  \"dependencies\": {\n    \"lodash\": \"^4.0.0\",\n    \"zod\": \"^3.0.0\",\n    \"axios\": \"^1.0.0\"\n  }\n}\n"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSetDependencyInsertsSorted(t *testing.T) {
+	original := "{\n\t\"dependencies\": {\n\t\t\"axios\": \"^1.0.0\",\n\t\t\"zod\": \"^3.0.0\"\n\t}\n}"
+	got := editPackageJSON(t, original, func(f *PackageJSONFile) {
+		f.SetDependency("dependencies", "lodash", "^4.0.0")
+	})
+	want := "{\n\t\"dependencies\": {\n\t\t\"axios\": \"^1.0.0\",\n\t\t\"lodash\": \"^4.0.0\",\n\t\t\"zod\": \"^3.0.0\"\n\t}\n}"
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSaveKeepsSingleLineLayout(t *testing.T) {
+	tests := []struct {
+		original string
+		want     string
+	}{
+		{
+			`{"name":"app","dependencies":{"zod":"^3.0.0"}}`,
+			`{"name":"app","dependencies":{"lodash":"^4.0.0","zod":"^3.0.0"},"devDependencies":{"jest":"^29.0.0"}}`,
+		},
+		{
+			"{ \"name\": \"app\", \"dependencies\": {} }\n",
+			"{ \"name\": \"app\", \"dependencies\": { \"lodash\": \"^4.0.0\" }, \"devDependencies\": { \"jest\": \"^29.0.0\" } }\n",
+		},
+	}
+	for _, tt := range tests {
+		got := editPackageJSON(t, tt.original, func(f *PackageJSONFile) {
+			f.SetDependency("dependencies", "lodash", "^4.0.0")
+			f.SetDependency("devDependencies", "jest", "^29.0.0")
+		})
+		if got != tt.want {
+			t.Errorf("got\n%s\nwant\n%s", got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Node's names for GOOS and GOARCH values that differ from Go's, as used in
+// the os and cpu fields of package.json.
+var (
+	nodePlatforms = map[string]string{"windows": "win32"}
+	nodeArchs     = map[string]string{"amd64": "x64", "386": "ia32", "ppc64le": "ppc64"}
+)
+
+// targetOS is the platform optional dependencies are picked for: --os or the
+// os config, and otherwise the one gopm runs on.
+func targetOS() string {
+	if values := flagValues("os"); len(values) > 0 {
+		return values[len(values)-1]
+	}
+	if value := getConfig().Get("os"); value != "" {
+		return value
+	}
+	if value, ok := nodePlatforms[runtime.GOOS]; ok {
+		return value
+	}
+	return runtime.GOOS
+}
+
+func targetCPU() string {
+	if values := flagValues("cpu"); len(values) > 0 {
+		return values[len(values)-1]
+	}
+	if value := getConfig().Get("cpu"); value != "" {
+		return value
+	}
+	if value, ok := nodeArchs[runtime.GOARCH]; ok {
+		return value
+	}
+	return runtime.GOARCH
+}
+
+// targetLibc is glibc or musl on Linux, told apart by musl's dynamic loader,
+// and empty elsewhere.
+func targetLibc() string {
+	if values := flagValues("libc"); len(values) > 0 {
+		return values[len(values)-1]
+	}
+	if value := getConfig().Get("libc"); value != "" {
+		return value
+	}
+	if targetOS() != "linux" {
+		return ""
+	}
+	if loaders, _ := filepath.Glob("/lib/ld-musl-*.so.1"); len(loaders) > 0 {
+		return "musl"
+	}
+	return "glibc"
+}
+
+// platformError reports why a package cannot be installed on the target
+// platform, or nil when its os, cpu and libc fields all allow it.
+func (p *LockedPackage) platformError() error {
+	checks := []struct {
+		field   string
+		allowed []string
+		current func() string
+	}{
+		{"os", p.OS, targetOS},
+		{"cpu", p.CPU, targetCPU},
+		{"libc", p.Libc, targetLibc},
+	}
+	for _, check := range checks {
+		if len(check.allowed) == 0 {
+			continue
+		}
+		if current := check.current(); !platformAllowed(check.allowed, current) {
+			return fmt.Errorf("unsupported platform: %s is %s, package supports %s", check.field, current, strings.Join(check.allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// platformAllowed applies an os, cpu or libc list: "!name" entries exclude a
+// value, and any plain entries are the only values allowed.
+func platformAllowed(allowed []string, current string) bool {
+	matched, positive := false, false
+	for _, entry := range allowed {
+		if excluded, ok := strings.CutPrefix(entry, "!"); ok {
+			if excluded == current {
+				return false
+			}
+			continue
+		}
+		positive = true
+		if entry == current {
+			matched = true
+		}
+	}
+	return matched || !positive
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type AuthError struct {
+	URL    string
+	Status string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("authentication failed for %s (%s): check the credentials for this registry in .npmrc", e.URL, e.Status)
+}
+
+// newRegistryRequest builds a GET request carrying whatever credentials
+// .npmrc configures for that exact host.
+func newRegistryRequest(rawURL string) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "gopm")
+	if auth := getConfig().authFor(req.URL); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return req, nil
+}
+
+// checkRegistryResponse turns a non-200 registry reply into an error, keeping
+// authentication failures distinct from missing packages.
+func checkRegistryResponse(resp *http.Response, what string) error {
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &AuthError{URL: resp.Request.URL.String(), Status: resp.Status}
+	case http.StatusNotFound:
+		return fmt.Errorf("package not found: %s", what)
+	}
+	return fmt.Errorf("failed to fetch %s: %s", what, resp.Status)
+}
+
+// stripAuthOnRedirect drops credentials when a registry redirects to another
+// host, e.g. a tarball CDN, and re-applies any configured for the new host.
+func stripAuthOnRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return fmt.Errorf("stopped after 10 redirects")
+	}
+	if req.URL.Host != via[0].URL.Host {
+		req.Header.Del("Authorization")
+		if auth := getConfig().authFor(req.URL); auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+	}
+	return nil
+}
+
+// authFor returns the Authorization header for u, matching npm's "nerf dart"
+// keys such as //registry.example.com/path/:_authToken from the most
+// specific path down to the bare host.
+func (c *NpmConfig) authFor(u *url.URL) string {
+	path := u.Path
+	if !strings.HasSuffix(path, "/") {
+		path = path[:strings.LastIndex(path, "/")+1]
+	}
+	if path == "" {
+		path = "/"
+	}
+	for {
+		if auth := c.authForNerfDart("//" + u.Host + path); auth != "" {
+			return auth
+		}
+		if path == "/" {
+			break
+		}
+		path = path[:strings.LastIndex(strings.TrimSuffix(path, "/"), "/")+1]
+	}
+	if registry, err := url.Parse(c.registryFor("")); err == nil && registry.Host == u.Host {
+		return c.authForNerfDart("")
+	}
+	return ""
+}
+
+func (c *NpmConfig) authForNerfDart(prefix string) string {
+	key := func(name string) string {
+		if prefix == "" {
+			return name
+		}
+		return prefix + ":" + name
+	}
+	if token := c.Get(key("_authToken")); token != "" {
+		return "Bearer " + token
+	}
+	if auth := c.Get(key("_auth")); auth != "" {
+		return "Basic " + auth
+	}
+	username, password := c.Get(key("username")), c.Get(key("_password"))
+	if username != "" && password != "" {
+		decoded, err := base64.StdEncoding.DecodeString(password)
+		if err != nil {
+			return ""
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+string(decoded)))
+	}
+	return ""
+}
+
+const (
+	CONNECT_TIMEOUT = 15 * time.Second
+	HEADER_TIMEOUT  = 30 * time.Second
+	IDLE_TIMEOUT    = 60 * time.Second
+)
+
+type RetryEvent struct {
+	URL     string
+	Attempt int
+	Reason  string
+}
+
+type retryPolicy struct {
+	retries    int
+	minTimeout time.Duration
+	maxTimeout time.Duration
+	factor     float64
+}
+
+var (
+	retryMu     sync.Mutex
+	retryEvents []RetryEvent
+)
+
+func recordRetry(rawURL string, attempt int, reason string) {
+	retryMu.Lock()
+	defer retryMu.Unlock()
+	retryEvents = append(retryEvents, RetryEvent{URL: rawURL, Attempt: attempt, Reason: reason})
+}
+
+func getRetries() []RetryEvent {
+	retryMu.Lock()
+	defer retryMu.Unlock()
+	return append([]RetryEvent(nil), retryEvents...)
+}
+
+// getRetryPolicy reads npm's fetch-retry-* settings.
+func getRetryPolicy() retryPolicy {
+	c := getConfig()
+	policy := retryPolicy{
+		retries:    2,
+		minTimeout: time.Second,
+		maxTimeout: 60 * time.Second,
+		factor:     10,
+	}
+	if n, err := strconv.Atoi(c.Get("fetch-retries")); err == nil && n >= 0 {
+		policy.retries = n
+	}
+	if ms, err := strconv.Atoi(c.Get("fetch-retry-mintimeout")); err == nil && ms >= 0 {
+		policy.minTimeout = time.Duration(ms) * time.Millisecond
+	}
+	if ms, err := strconv.Atoi(c.Get("fetch-retry-maxtimeout")); err == nil && ms >= 0 {
+		policy.maxTimeout = time.Duration(ms) * time.Millisecond
+	}
+	if f, err := strconv.ParseFloat(c.Get("fetch-retry-factor"), 64); err == nil && f >= 1 {
+		policy.factor = f
+	}
+	return policy
+}
+
+// backoff returns a jittered exponential delay for the given attempt.
+func (p retryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.minTimeout) * math.Pow(p.factor, float64(attempt))
+	if delay > float64(p.maxTimeout) {
+		delay = float64(p.maxTimeout)
+	}
+	return time.Duration(delay/2 + rand.Float64()*delay/2)
+}
+
+// registryDo performs an idempotent registry GET, retrying connection
+// failures, 5xx replies and 429s with backoff or the server's Retry-After.
+// A Retry-After longer than fetch-retry-maxtimeout fails the request.
+func registryDo(req *http.Request) (*http.Response, error) {
+	policy := getRetryPolicy()
+	for attempt := 0; ; attempt++ {
+		resp, err := doWithIdleTimeout(req.Clone(req.Context()))
+		retry, wait, reason := shouldRetry(resp, err)
+		if !retry || attempt >= policy.retries {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if wait > policy.maxTimeout {
+			return nil, fmt.Errorf("%s: %s, retry after %v exceeds fetch-retry-maxtimeout (%v)",
+				req.URL, reason, wait.Round(time.Second), policy.maxTimeout)
+		}
+		if wait <= 0 {
+			wait = policy.backoff(attempt)
+		}
+		recordRetry(req.URL.String(), attempt+1, reason)
+		time.Sleep(wait)
+	}
+}
+
+func shouldRetry(resp *http.Response, err error) (bool, time.Duration, string) {
+	if err != nil {
+		var certErr *tls.CertificateVerificationError
+		if errors.As(err, &certErr) {
+			return false, 0, ""
+		}
+		return true, 0, err.Error()
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true, parseRetryAfter(resp.Header.Get("Retry-After")), resp.Status
+	case http.StatusRequestTimeout, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true, 0, resp.Status
+	}
+	return false, 0, ""
+}
+
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
+
+// doWithIdleTimeout cancels a request whose body stops making progress for
+// IDLE_TIMEOUT, rather than capping the whole transfer like Client.Timeout.
+func doWithIdleTimeout(req *http.Request) (*http.Response, error) {
+	client, err := getHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(CONNECT_TIMEOUT+HEADER_TIMEOUT, cancel)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		timer.Stop()
+		cancel()
+		return nil, err
+	}
+	timer.Reset(IDLE_TIMEOUT)
+	resp.Body = &idleTimeoutBody{ReadCloser: resp.Body, timer: timer, cancel: cancel}
+	return resp, nil
+}
+
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timer  *time.Timer
+	cancel context.CancelFunc
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.timer.Reset(IDLE_TIMEOUT)
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// resumableBody continues an interrupted tarball download with an HTTP
+// Range request instead of starting over.
+type resumableBody struct {
+	req       *http.Request
+	body      io.ReadCloser
+	validator string
+	received  int64
+	attempts  int
+	policy    retryPolicy
+}
+
+func newResumableBody(req *http.Request, resp *http.Response) *resumableBody {
+	validator := resp.Header.Get("ETag")
+	if validator == "" {
+		validator = resp.Header.Get("Last-Modified")
+	}
+	return &resumableBody{
+		req:       req,
+		body:      resp.Body,
+		validator: validator,
+		policy:    getRetryPolicy(),
+	}
+}
+
+func (b *resumableBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.body.Read(p)
+		b.received += int64(n)
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+		if n > 0 {
+			// hand over what arrived; the next Read sees the error again
+			// and resumes from here
+			return n, nil
+		}
+		if b.attempts >= b.policy.retries {
+			return 0, err
+		}
+		b.attempts++
+		recordRetry(b.req.URL.String(), b.attempts, fmt.Sprintf("resuming after %s: %v", formatBytes(b.received), err))
+		b.body.Close()
+		time.Sleep(b.policy.backoff(b.attempts - 1))
+		if err := b.reopen(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (b *resumableBody) reopen() error {
+	req := b.req.Clone(b.req.Context())
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", b.received))
+	if b.validator != "" {
+		req.Header.Set("If-Range", b.validator)
+	}
+	resp, err := registryDo(req)
+	if err != nil {
+		return err
+	}
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if _, err := io.CopyN(io.Discard, resp.Body, b.received); err != nil {
+			resp.Body.Close()
+			return err
+		}
+	default:
+		resp.Body.Close()
+		return checkRegistryResponse(resp, b.req.URL.String())
+	}
+	b.body = resp.Body
+	return nil
+}
+
+func (b *resumableBody) Close() error {
+	return b.body.Close()
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+)
+
+// withTestConfig replaces the loaded .npmrc settings with values for the
+// duration of the test.
+func withTestConfig(t *testing.T, values map[string]string) {
+	t.Helper()
+	npmConfigOnce.Do(func() {})
+	npmConfig = &NpmConfig{values: values}
+	httpClient, httpClientOnce = nil, sync.Once{}
+	t.Cleanup(func() {
+		npmConfig, npmConfigOnce = nil, sync.Once{}
+		httpClient, httpClientOnce = nil, sync.Once{}
+	})
+}
+
+func TestResumableBodyResumesAfterDroppedConnection(t *testing.T) {
+	withTestConfig(t, map[string]string{"fetch-retries": "2", "fetch-retry-mintimeout": "1"})
+	payload := bytes.Repeat([]byte("gopm tarball bytes "), 4096)
+	half := len(payload) / 2
+	var ranges []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		if rng := r.Header.Get("Range"); rng != "" {
+			ranges = append(ranges, rng)
+			var start int
+			fmt.Sscanf(rng, "bytes=%d-", &start)
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(payload)-1, len(payload)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(payload[start:])
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(payload)))
+		w.WriteHeader(http.StatusOK)
+		w.Write(payload[:half])
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/pkg.tgz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := registryDo(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := newResumableBody(req, resp)
+	defer body.Close()
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("reading the body failed instead of resuming: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("got %d bytes, want the %d byte payload", len(got), len(payload))
+	}
+	if len(ranges) != 1 || !strings.HasPrefix(ranges[0], "bytes=") || ranges[0] == "bytes=0-" {
+		t.Errorf("range requests = %q, want one resuming past the first bytes", ranges)
+	}
+}
+
+// resetBody returns its bytes together with a connection reset, the way a
+// read that was cut off mid-stream often does.
+type resetBody struct {
+	data []byte
+}
+
+func (b *resetBody) Read(p []byte) (int, error) {
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, syscall.ECONNRESET
+}
+
+func (b *resetBody) Close() error {
+	return nil
+}
+
+func TestResumableBodyResumesAfterResetWithData(t *testing.T) {
+	withTestConfig(t, map[string]string{"fetch-retries": "2", "fetch-retry-mintimeout": "1"})
+	payload := []byte("0123456789abcdefghij")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var start int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(payload[start:])
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/pkg.tgz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := newResumableBody(req, &http.Response{Header: http.Header{}, Body: &resetBody{data: payload[:7]}})
+	got, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("reading the body failed instead of resuming: %v", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Errorf("got %q, want %q", got, payload)
+	}
+}
+
+func TestRegistryDoFailsOnLongRetryAfter(t *testing.T) {
+	withTestConfig(t, map[string]string{"fetch-retries": "2", "fetch-retry-maxtimeout": "1000"})
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	req, err := http.NewRequest("GET", server.URL+"/pkg", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := registryDo(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("registryDo succeeded, want an error about Retry-After")
+	}
+	if !strings.Contains(err.Error(), "retry after 1h0m0s") {
+		t.Errorf("error = %v, want it to mention the Retry-After delay", err)
+	}
+	if requests != 1 {
+		t.Errorf("made %d requests, want 1", requests)
+	}
+}
@@ -0,0 +1,631 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Dependency kinds, named like npm's --omit values. A package that can only
+// be reached through edges of one kind is a package of that kind and may be
+// left out.
+const (
+	DEP_PROD     = ""
+	DEP_DEV      = "dev"
+	DEP_PEER     = "peer"
+	DEP_OPTIONAL = "optional"
+)
+
+// omittedKinds returns the dependency kinds to leave out, from --omit (or
+// the omit config), --production and NODE_ENV=production, less any given
+// to --include.
+func omittedKinds() map[string]bool {
+	omit := make(map[string]bool)
+	values := flagValues("omit")
+	if len(values) == 0 {
+		values = strings.Split(getConfig().Get("omit"), "\n")
+		if os.Getenv("NODE_ENV") == "production" {
+			omit[DEP_DEV] = true
+		}
+	}
+	for _, value := range values {
+		for _, kind := range strings.Split(value, ",") {
+			if kind = strings.TrimSpace(kind); kind != "" {
+				omit[kind] = true
+			}
+		}
+	}
+	if hasFlag("production") {
+		omit[DEP_DEV] = true
+	}
+	for _, value := range flagValues("include") {
+		for _, kind := range strings.Split(value, ",") {
+			delete(omit, strings.TrimSpace(kind))
+		}
+	}
+	return omit
+}
+
+// depNode is a package placed at a concrete node_modules location. children
+// are the packages placed in its own node_modules, edges are what each of its
+// dependencies resolves to under Node's lookup rules, and kinds records the
+// edges that are not plain dependencies.
+type depNode struct {
+	name     string
+	path     string
+	pkg      *LockedPackage
+	parent   *depNode
+	children map[string]*depNode
+	edges    map[string]*depNode
+	kinds    map[string]string
+}
+
+type depTree struct {
+	baseDir string
+	root    *depNode
+}
+
+type depEdge struct {
+	name  string
+	spec  string
+	kind  string
+	fresh bool
+}
+
+// resolver builds an npm v3 style hoisted tree: every package is placed in
+// the highest node_modules where it does not conflict with another version
+// of the same name, and only nested below a conflict.
+type resolver struct {
+	tree        *depTree
+	legacyPeers bool
+	workspaces  map[string]string
+	stale       map[string]bool
+	locked      map[string][]*LockedPackage
+	packuments  map[string]*RegistryResponse
+	mu          sync.Mutex
+	failures    []InstallResult
+}
+
+func newDepNode(name string, pkg *LockedPackage, parent *depNode) *depNode {
+	node := &depNode{
+		name:     name,
+		pkg:      pkg,
+		parent:   parent,
+		children: make(map[string]*depNode),
+		edges:    make(map[string]*depNode),
+		kinds:    make(map[string]string),
+	}
+	if parent != nil {
+		node.path = lockPath(filepath.Join(parent.path, NODE_MODULES_DIR), name)
+		parent.children[name] = node
+	}
+	return node
+}
+
+// newResolver starts a tree for the root package from what lock already
+// places. Workspaces are linked directly under the root and their
+// dependencies resolve from there.
+func newResolver(baseDir string, root *LockedPackage, lock *Lockfile, workspaces []Workspace) *resolver {
+	rootDeps := root.allDependencies()
+	r := &resolver{
+		tree:        &depTree{baseDir: baseDir, root: newDepNode("", root, nil)},
+		legacyPeers: boolOption("legacy-peer-deps", false),
+		workspaces:  make(map[string]string),
+		stale:       make(map[string]bool),
+		locked:      make(map[string][]*LockedPackage),
+		packuments:  make(map[string]*RegistryResponse),
+	}
+	for _, ws := range workspaces {
+		newDepNode(ws.Name, ws.lockedLink(), r.tree.root)
+		// private workspaces often have no version; any of theirs will do
+		version := ws.PkgJSON.Version
+		if version == "" {
+			version = "*"
+		}
+		r.workspaces[ws.Name] = version
+	}
+	if lock == nil {
+		for name := range rootDeps {
+			r.stale[name] = true
+		}
+		return r
+	}
+	r.stale = lock.staleRoots(rootDeps)
+	paths := make([]string, 0, len(lock.Packages))
+	for path := range lock.Packages {
+		if path != "" {
+			paths = append(paths, path)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.Count(paths[i], "/") < strings.Count(paths[j], "/") ||
+			(strings.Count(paths[i], "/") == strings.Count(paths[j], "/") && paths[i] < paths[j])
+	})
+	for _, path := range paths {
+		pkg := lock.Packages[path]
+		dir, name := splitLockPath(path)
+		parent := r.tree.find(strings.TrimSuffix(filepath.ToSlash(dir), "/"+NODE_MODULES_DIR))
+		if parent == nil || pkg.Link {
+			continue
+		}
+		if _, isWorkspace := r.workspaces[name]; parent == r.tree.root && (r.stale[name] || isWorkspace) {
+			continue
+		}
+		newDepNode(name, pkg, parent)
+		realName := pkg.realName(name)
+		r.locked[realName] = append(r.locked[realName], pkg)
+	}
+	return r
+}
+
+func (t *depTree) find(path string) *depNode {
+	if path == "" || path == NODE_MODULES_DIR {
+		return t.root
+	}
+	node := t.root
+	rest := strings.TrimPrefix(path, NODE_MODULES_DIR+"/")
+	for _, segment := range strings.Split(rest, "/"+NODE_MODULES_DIR+"/") {
+		child, ok := node.children[segment]
+		if !ok {
+			return nil
+		}
+		node = child
+	}
+	return node
+}
+
+func (t *depTree) walk(fn func(*depNode)) {
+	var visit func(*depNode)
+	visit = func(node *depNode) {
+		names := make([]string, 0, len(node.children))
+		for name := range node.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fn(node.children[name])
+			visit(node.children[name])
+		}
+	}
+	visit(t.root)
+}
+
+// edgesOf lists a node's dependencies. Only the root and workspaces record
+// devDependencies, so those of published packages are never installed.
+// With --legacy-peer-deps, peer dependencies are ignored as npm 6 did.
+func (r *resolver) edgesOf(node *depNode) []depEdge {
+	deps := node.pkg.allDependencies()
+	edges := make([]depEdge, 0, len(deps))
+	for name, spec := range deps {
+		kind := node.pkg.dependencyKind(name)
+		if kind == DEP_PEER && r.legacyPeers {
+			continue
+		}
+		edges = append(edges, depEdge{
+			name:  name,
+			spec:  spec,
+			kind:  kind,
+			fresh: node == r.tree.root && r.stale[name],
+		})
+	}
+	if node == r.tree.root {
+		for name, version := range r.workspaces {
+			if _, ok := deps[name]; !ok {
+				edges = append(edges, depEdge{name: name, spec: version})
+			}
+		}
+	}
+	sort.Slice(edges, func(i, j int) bool {
+		return edges[i].name < edges[j].name
+	})
+	return edges
+}
+
+func (r *resolver) resolve() []peerConflict {
+	visited := map[*depNode]bool{r.tree.root: true}
+	queue := []*depNode{r.tree.root}
+	for len(queue) > 0 {
+		level := queue
+		queue = nil
+		r.prefetch(level)
+		// peers go first so they are placed next to the packages that
+		// need them before anything else claims those names
+		for _, peers := range []bool{true, false} {
+			for _, node := range level {
+				for _, edge := range r.edgesOf(node) {
+					if (edge.kind == DEP_PEER) != peers {
+						continue
+					}
+					target, err := r.resolveEdge(node, edge)
+					if err != nil {
+						r.failures = append(r.failures, InstallResult{
+							Task: InstallTask{
+								Name:     edge.name,
+								Version:  edge.spec,
+								IsRoot:   node == r.tree.root,
+								Optional: edge.kind == DEP_OPTIONAL || node.pkg.Optional,
+							},
+							Error: err,
+						})
+						continue
+					}
+					node.edges[edge.name] = target
+					if edge.kind != DEP_PROD {
+						node.kinds[edge.name] = edge.kind
+					}
+					if !visited[target] {
+						visited[target] = true
+						queue = append(queue, target)
+					}
+				}
+			}
+		}
+	}
+	r.prune(visited)
+	r.tree.markKinds()
+	conflicts := r.checkPeers()
+	r.reportPeerConflicts(conflicts)
+	return conflicts
+}
+
+// reachable returns the nodes that can be reached from the root without
+// following an edge of an omitted kind.
+func (t *depTree) reachable(omit map[string]bool) map[*depNode]bool {
+	return t.reachableBy(func(from *depNode, name string, to *depNode) bool {
+		return !omit[from.kinds[name]]
+	})
+}
+
+// installable returns the nodes reachable without omitted edges and without
+// optional edges to packages built for another platform.
+func (t *depTree) installable(omit map[string]bool) map[*depNode]bool {
+	return t.reachableBy(func(from *depNode, name string, to *depNode) bool {
+		kind := from.kinds[name]
+		return !omit[kind] && (kind != DEP_OPTIONAL || to.pkg.platformError() == nil)
+	})
+}
+
+func (t *depTree) reachableBy(follow func(from *depNode, name string, to *depNode) bool) map[*depNode]bool {
+	seen := map[*depNode]bool{t.root: true}
+	queue := []*depNode{t.root}
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+		for name, target := range node.edges {
+			if seen[target] || !follow(node, name, target) {
+				continue
+			}
+			seen[target] = true
+			queue = append(queue, target)
+		}
+	}
+	return seen
+}
+
+// markKinds flags every package that only dev, peer or optional edges lead
+// to, so the lockfile can tell which packages --omit leaves out.
+func (t *depTree) markKinds() {
+	nonDev := t.reachable(map[string]bool{DEP_DEV: true})
+	nonPeer := t.reachable(map[string]bool{DEP_PEER: true})
+	nonOptional := t.reachable(map[string]bool{DEP_OPTIONAL: true})
+	t.walk(func(node *depNode) {
+		dev, peer, optional := !nonDev[node], !nonPeer[node], !nonOptional[node]
+		if node.pkg.Dev != dev || node.pkg.Peer != peer || node.pkg.Optional != optional {
+			pkg := *node.pkg
+			pkg.Dev, pkg.Peer, pkg.Optional = dev, peer, optional
+			node.pkg = &pkg
+		}
+	})
+}
+
+// prefetch downloads, concurrently, the packuments that the next level of
+// edges is likely to need so resolveEdge rarely blocks on the network.
+func (r *resolver) prefetch(level []*depNode) {
+	needed := make(map[string]bool)
+	for _, node := range level {
+		for _, edge := range r.edgesOf(node) {
+			realName, spec := parseDependencySpec(edge.name, edge.spec)
+			if existing := r.lookup(edge.from(node), edge.name); existing != nil && nodeSatisfies(existing, realName, spec) {
+				continue
+			}
+			if !edge.fresh && r.lockedMatch(realName, spec) != nil {
+				continue
+			}
+			if _, ok := r.packuments[realName]; !ok {
+				needed[realName] = true
+			}
+		}
+	}
+	names := make(chan string, len(needed))
+	for name := range needed {
+		names <- name
+	}
+	close(names)
+	var wg sync.WaitGroup
+	for i := 0; i < min(MAX_CONCURRENT, len(needed)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				if registryData, err := getPackageFromRegistry(name); err == nil {
+					r.mu.Lock()
+					r.packuments[name] = registryData
+					r.mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// from is the node whose node_modules the edge starts resolving in. A peer
+// dependency must be visible to the packages next to its dependent, so it
+// resolves from the dependent's parent.
+func (e depEdge) from(node *depNode) *depNode {
+	if e.kind == DEP_PEER && node.parent != nil {
+		return node.parent
+	}
+	return node
+}
+
+func (r *resolver) lookup(node *depNode, name string) *depNode {
+	for cur := node; cur != nil; cur = cur.parent {
+		if existing, ok := cur.children[name]; ok {
+			return existing
+		}
+	}
+	return nil
+}
+
+func (r *resolver) resolveEdge(node *depNode, edge depEdge) (*depNode, error) {
+	realName, spec := parseDependencySpec(edge.name, edge.spec)
+	var target *depNode
+	for cur := edge.from(node); cur != nil; cur = cur.parent {
+		if existing, ok := cur.children[edge.name]; ok {
+			if nodeSatisfies(existing, realName, spec) {
+				return existing, nil
+			}
+			if cur == node {
+				delete(node.children, edge.name)
+				target = node
+			}
+			if target == nil && edge.kind == DEP_PEER {
+				// a conflicting peer is kept; reportPeerConflicts explains it
+				return existing, nil
+			}
+			break
+		}
+		if cur.shadows(edge.name) {
+			break
+		}
+		target = cur
+	}
+	if target == nil {
+		return nil, fmt.Errorf("cannot place %s@%s under %s without breaking another dependency", edge.name, edge.spec, node.path)
+	}
+	pkg, err := r.pick(realName, spec, edge.fresh)
+	if err != nil {
+		return nil, err
+	}
+	if realName != edge.name && pkg.Name == "" {
+		aliased := *pkg
+		aliased.Name = realName
+		pkg = &aliased
+	}
+	return newDepNode(edge.name, pkg, target), nil
+}
+
+// shadows reports whether placing name in n's node_modules would change what
+// an already resolved dependency somewhere below n points at.
+func (n *depNode) shadows(name string) bool {
+	var visit func(*depNode) bool
+	visit = func(v *depNode) bool {
+		if target, ok := v.edges[name]; ok && target.parent.isAncestorOf(n) {
+			return true
+		}
+		for _, child := range v.children {
+			if _, shielded := child.children[name]; shielded {
+				continue
+			}
+			if visit(child) {
+				return true
+			}
+		}
+		return false
+	}
+	return visit(n)
+}
+
+func (n *depNode) isAncestorOf(other *depNode) bool {
+	for cur := other; cur != nil; cur = cur.parent {
+		if cur == n {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *resolver) lockedMatch(realName, spec string) *LockedPackage {
+	rng, err := parseRange(spec)
+	if err != nil {
+		return nil
+	}
+	var best *LockedPackage
+	for _, pkg := range r.locked[realName] {
+		v, err := parseSemVer(pkg.Version)
+		if err != nil || !rng.Satisfies(v) {
+			continue
+		}
+		if best == nil || compareVersions(pkg.Version, best.Version) > 0 {
+			best = pkg
+		}
+	}
+	return best
+}
+
+func (r *resolver) pick(realName, spec string, fresh bool) (*LockedPackage, error) {
+	if !fresh {
+		if pkg := r.lockedMatch(realName, spec); pkg != nil {
+			return pkg, nil
+		}
+	}
+	r.mu.Lock()
+	registryData, ok := r.packuments[realName]
+	r.mu.Unlock()
+	if !ok {
+		var err error
+		registryData, err = getPackageFromRegistry(realName)
+		if err != nil {
+			return nil, err
+		}
+		r.mu.Lock()
+		r.packuments[realName] = registryData
+		r.mu.Unlock()
+	}
+	version, err := resolveVersion(registryData, spec)
+	if err != nil {
+		return nil, err
+	}
+	return lockedFromManifest(registryData.Versions[version]), nil
+}
+
+func (r *resolver) prune(reachable map[*depNode]bool) {
+	var visit func(*depNode)
+	visit = func(node *depNode) {
+		for name, child := range node.children {
+			if !reachable[child] {
+				delete(node.children, name)
+				continue
+			}
+			visit(child)
+		}
+	}
+	visit(r.tree.root)
+}
+
+func lockedFromManifest(pkg Package) *LockedPackage {
+	locked := &LockedPackage{
+		Version:              pkg.Version,
+		Resolved:             pkg.Dist.Tarball,
+		Integrity:            pkg.Dist.Integrity,
+		Dependencies:         pkg.Dependencies,
+		PeerDependencies:     pkg.PeerDependencies,
+		PeerDependenciesMeta: pkg.PeerDependenciesMeta,
+		OptionalDependencies: pkg.OptionalDependencies,
+		OS:                   pkg.OS,
+		CPU:                  pkg.CPU,
+		Libc:                 pkg.Libc,
+		Engines:              pkg.Engines,
+	}
+	if locked.Integrity == "" && pkg.Dist.Shasum != "" {
+		locked.Integrity = shasumToIntegrity(pkg.Dist.Shasum)
+	}
+	return locked
+}
+
+// parseDependencySpec splits npm: aliases into the real package name and the
+// range that applies to it.
+func parseDependencySpec(name, spec string) (string, string) {
+	if !strings.HasPrefix(spec, "npm:") {
+		return name, spec
+	}
+	target := strings.TrimPrefix(spec, "npm:")
+	if idx := strings.LastIndex(target, "@"); idx > 0 {
+		return target[:idx], target[idx+1:]
+	}
+	return target, "latest"
+}
+
+func nodeSatisfies(node *depNode, realName, spec string) bool {
+	if node.pkg.realName(node.name) != realName {
+		return false
+	}
+	// a versionless workspace is still the package its name refers to, and
+	// must never be swapped for a registry package of the same name
+	if node.pkg.Link && node.pkg.Version == "" {
+		return true
+	}
+	if _, err := parseRange(spec); err != nil {
+		return true
+	}
+	return satisfiesRange(node.pkg.Version, spec)
+}
+
+// installTasks returns a task for every registry package in installed.
+func (t *depTree) installTasks(installed map[*depNode]bool) []InstallTask {
+	var tasks []InstallTask
+	t.walk(func(node *depNode) {
+		if node.pkg.Link || !installed[node] {
+			return
+		}
+		tasks = append(tasks, InstallTask{
+			Name:     node.name,
+			Version:  node.pkg.Version,
+			Dir:      filepath.Join(t.baseDir, filepath.FromSlash(node.parent.path), NODE_MODULES_DIR),
+			IsRoot:   node.parent == t.root,
+			Optional: node.pkg.Optional,
+			Locked:   node.pkg,
+		})
+	})
+	return tasks
+}
+
+// removeExtraneous deletes packages a previous lockfile placed that are no
+// longer part of the tree, or that are not installed this time.
+func (t *depTree) removeExtraneous(previous *Lockfile, installed map[*depNode]bool) {
+	if previous == nil {
+		return
+	}
+	for path := range previous.Packages {
+		if path == "" || installed[t.find(path)] {
+			continue
+		}
+		os.RemoveAll(filepath.Join(t.baseDir, filepath.FromSlash(path)))
+	}
+}
+
+// linkWorkspaces creates the node_modules symlinks for every workspace in
+// the tree, before anything is installed beneath them.
+func (t *depTree) linkWorkspaces() []InstallResult {
+	var failures []InstallResult
+	for name, node := range t.root.children {
+		if !node.pkg.Link {
+			continue
+		}
+		if err := linkWorkspace(t.baseDir, node.path, node.pkg.Resolved); err != nil {
+			failures = append(failures, InstallResult{
+				Task:  InstallTask{Name: name, Version: node.pkg.Version, IsRoot: true},
+				Error: fmt.Errorf("failed to link workspace: %v", err),
+			})
+		}
+	}
+	return failures
+}
+
+// resolveAndInstall resolves the dependencies of root, plus those of any
+// workspaces, into a hoisted tree under baseDir, reusing whatever lock
+// already pins, and installs every package in it that is not omitted. It
+// returns an error, having touched nothing on disk, when peer conflicts
+// under strict-peer-deps or engines under engine-strict abort the install.
+func resolveAndInstall(baseDir string, root *LockedPackage, lock *Lockfile, workspaces []Workspace) (*depTree, []InstallResult, error) {
+	resolveStart := time.Now()
+	r := newResolver(baseDir, root, lock, workspaces)
+	conflicts := r.resolve()
+	if len(conflicts) > 0 && boolOption("strict-peer-deps", false) {
+		return r.tree, r.failures, fmt.Errorf("not installing: strict-peer-deps is set and %d peer dependencies conflict", len(conflicts))
+	}
+	installed := r.tree.installable(omittedKinds())
+	tasks := r.tree.installTasks(installed)
+	ui.Info(fmt.Sprintf("resolved %d packages in %v", len(tasks), time.Since(resolveStart).Round(time.Millisecond)))
+	if err := checkEngines(root, tasks); err != nil {
+		return r.tree, r.failures, err
+	}
+	r.tree.removeExtraneous(lock, installed)
+	results := append(r.failures, r.tree.linkWorkspaces()...)
+	results = append(results, installPackagesConcurrently(tasks)...)
+	return r.tree, results, nil
+}
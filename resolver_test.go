@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestNodeSatisfiesVersionlessWorkspace(t *testing.T) {
+	link := &depNode{name: "ws", pkg: &LockedPackage{Link: true}}
+	for _, spec := range []string{"", "*", "^1.0.0"} {
+		if !nodeSatisfies(link, "ws", spec) {
+			t.Errorf("versionless workspace should satisfy %q", spec)
+		}
+	}
+	if nodeSatisfies(link, "other", "*") {
+		t.Error("workspace ws should not satisfy a dependency on other")
+	}
+	registry := &depNode{name: "ws", pkg: &LockedPackage{}}
+	if nodeSatisfies(registry, "ws", "") {
+		t.Error("a versionless registry package should not satisfy anything")
+	}
+}
+
+func TestResolveKeepsVersionlessWorkspaceLinked(t *testing.T) {
+	workspaces := []Workspace{{
+		Name:    "ws",
+		Dir:     "packages/ws",
+		PkgJSON: &PackageJSON{Name: "ws"},
+	}}
+	for _, root := range []*LockedPackage{
+		{Name: "app"},
+		{Name: "app", Dependencies: map[string]string{"ws": "*"}},
+	} {
+		r := newResolver("", root, nil, workspaces)
+		r.resolve()
+		if len(r.failures) > 0 {
+			t.Fatalf("resolve failed: %v", r.failures[0].Error)
+		}
+		node := r.tree.root.edges["ws"]
+		if node == nil || !node.pkg.Link || node.pkg.Resolved != "packages/ws" {
+			t.Errorf("ws resolved to %+v, want the workspace link", node)
+		}
+	}
+}
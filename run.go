@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// runCommandScripts implements gopm run: with no name it lists the scripts
+// in package.json, otherwise it runs the named one with any extra args, in
+// the root package or in the workspaces selected with --workspace(s).
+func runCommandScripts(args []string) {
+	if workspacesRequested() {
+		runWorkspaceScripts(args)
+		return
+	}
+	pkgJSON, err := readPackageJSON()
+	if err != nil {
+		ui.Error(fmt.Sprintf("error reading package.json: %v", err))
+		exitCode = 1
+		return
+	}
+	if len(args) == 0 {
+		listScripts(pkgJSON)
+		return
+	}
+	exitCode = runScript(".", pkgJSON, args[0], scriptArgs(args[1:]))
+}
+
+// scriptArgs drops the "--" separating gopm's arguments from the script's.
+func scriptArgs(args []string) []string {
+	if len(args) > 0 && args[0] == "--" {
+		return args[1:]
+	}
+	return args
+}
+
+func listScripts(pkgJSON *PackageJSON) {
+	if len(pkgJSON.Scripts) == 0 {
+		ui.Warning(fmt.Sprintf("no scripts found in %s", pkgJSON.Name))
+		return
+	}
+	names := make([]string, 0, len(pkgJSON.Scripts))
+	for name := range pkgJSON.Scripts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	ui.Header(fmt.Sprintf("scripts available in %s", pkgJSON.Name))
+	for _, name := range names {
+		ui.bold.Printf("  %s\n", name)
+		fmt.Printf("    %s\n", pkgJSON.Scripts[name])
+	}
+}
+
+// runScript runs pre<name>, name and post<name> in dir, stopping at the first
+// failure, and returns the exit code to propagate.
+func runScript(dir string, pkgJSON *PackageJSON, name string, args []string) int {
+	script, ok := pkgJSON.Scripts[name]
+	if !ok && name == "start" {
+		if _, err := os.Stat(filepath.Join(dir, "server.js")); err == nil {
+			script, ok = "node server.js", true
+		}
+	}
+	if !ok {
+		ui.Error(fmt.Sprintf("missing script: %s", name))
+		if len(pkgJSON.Scripts) > 0 {
+			ui.Info("run gopm run to list the available scripts")
+		}
+		return 1
+	}
+	if len(args) > 0 {
+		script += " " + quoteScriptArgs(args)
+	}
+	events := []string{name}
+	if !scriptsIgnored() {
+		events = []string{"pre" + name, name, "post" + name}
+	}
+	for _, event := range events {
+		command, ok := pkgJSON.Scripts[event]
+		if event == name {
+			command, ok = script, true
+		}
+		if !ok {
+			continue
+		}
+		if code := runScriptInteractive(dir, pkgJSON, event, command); code != 0 {
+			return code
+		}
+	}
+	return 0
+}
+
+// runScriptInteractive runs a script attached to the terminal, the way npm
+// run does, rather than capturing its output like install scripts.
+func runScriptInteractive(dir string, pkgJSON *PackageJSON, event, script string) int {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
+	rootDir, err := os.Getwd()
+	if err != nil {
+		ui.Error(err.Error())
+		return 1
+	}
+	ui.bold.Printf("\n> %s@%s %s\n", pkgJSON.Name, pkgJSON.Version, event)
+	ui.bold.Printf("> %s\n\n", script)
+	cmd := scriptCommand(script)
+	cmd.Dir = absDir
+	cmd.Env = scriptEnv(rootDir, absDir, pkgJSON, event, script)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			ui.Error(fmt.Sprintf("%s script failed with exit code %d", event, exitErr.ExitCode()))
+			if exitErr.ExitCode() > 0 {
+				return exitErr.ExitCode()
+			}
+			return 1
+		}
+		ui.Error(fmt.Sprintf("failed to run %s script: %v", event, err))
+		return 1
+	}
+	return 0
+}
+
+// quoteScriptArgs quotes args for the shell that scriptCommand uses.
+func quoteScriptArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if runtime.GOOS == "windows" && getConfig().Get("script-shell") == "" {
+			quoted[i] = `"` + strings.ReplaceAll(arg, `"`, `\"`) + `"`
+		} else {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		}
+	}
+	return strings.Join(quoted, " ")
+}
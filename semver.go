@@ -0,0 +1,418 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// SemVer is a parsed semantic version. Build metadata is kept for display
+// but never takes part in comparisons.
+type SemVer struct {
+	Major      uint64
+	Minor      uint64
+	Patch      uint64
+	Prerelease []string
+	Build      []string
+}
+
+type partialVersion struct {
+	major, minor, patch string
+	prerelease          []string
+	build               []string
+}
+
+type comparator struct {
+	op      string
+	version *SemVer
+}
+
+// SemverRange is a node-semver range: a union (||) of comparator sets, each
+// of which is an intersection of primitive comparators.
+type SemverRange struct {
+	raw  string
+	sets [][]comparator
+}
+
+var (
+	partialVersionRe = regexp.MustCompile(`^[v=]*\s*([0-9]+|[xX*])(?:\.([0-9]+|[xX*])(?:\.([0-9]+|[xX*])(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?(?:\+([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?)?)?$`)
+	hyphenRangeRe    = regexp.MustCompile(`^\s*(\S+)\s+-\s+(\S+)\s*$`)
+	operatorSpaceRe  = regexp.MustCompile(`(~>|<=|>=|[~^<>=])\s+`)
+	comparatorOps    = []string{"~>", ">=", "<=", "~", "^", ">", "<", "="}
+)
+
+func parseSemVer(s string) (*SemVer, error) {
+	p, err := parsePartialVersion(strings.TrimSpace(s))
+	if err != nil {
+		return nil, err
+	}
+	if isWildcard(p.major) || isWildcard(p.minor) || isWildcard(p.patch) {
+		return nil, fmt.Errorf("invalid version: %s", s)
+	}
+	return p.semver(), nil
+}
+
+func parsePartialVersion(s string) (*partialVersion, error) {
+	m := partialVersionRe.FindStringSubmatch(s)
+	if m == nil {
+		return nil, fmt.Errorf("invalid version: %s", s)
+	}
+	p := &partialVersion{major: m[1], minor: m[2], patch: m[3]}
+	if m[4] != "" {
+		p.prerelease = strings.Split(m[4], ".")
+	}
+	if m[5] != "" {
+		p.build = strings.Split(m[5], ".")
+	}
+	if (p.prerelease != nil || p.build != nil) && isWildcard(p.patch) {
+		return nil, fmt.Errorf("invalid version: %s", s)
+	}
+	for _, part := range []string{p.major, p.minor, p.patch} {
+		if !isWildcard(part) {
+			if _, err := strconv.ParseUint(part, 10, 64); err != nil {
+				return nil, fmt.Errorf("invalid version: %s", s)
+			}
+		}
+	}
+	return p, nil
+}
+
+func isWildcard(part string) bool {
+	return part == "" || part == "x" || part == "X" || part == "*"
+}
+
+func (p *partialVersion) number(part string) uint64 {
+	if isWildcard(part) {
+		return 0
+	}
+	n, _ := strconv.ParseUint(part, 10, 64)
+	return n
+}
+
+func (p *partialVersion) semver() *SemVer {
+	return &SemVer{
+		Major:      p.number(p.major),
+		Minor:      p.number(p.minor),
+		Patch:      p.number(p.patch),
+		Prerelease: p.prerelease,
+		Build:      p.build,
+	}
+}
+
+func newSemVer(major, minor, patch uint64, prerelease ...string) *SemVer {
+	return &SemVer{Major: major, Minor: minor, Patch: patch, Prerelease: prerelease}
+}
+
+func (v *SemVer) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Prerelease) > 0 {
+		s += "-" + strings.Join(v.Prerelease, ".")
+	}
+	if len(v.Build) > 0 {
+		s += "+" + strings.Join(v.Build, ".")
+	}
+	return s
+}
+
+func (v *SemVer) Compare(o *SemVer) int {
+	if c := compareUint(v.Major, o.Major); c != 0 {
+		return c
+	}
+	if c := compareUint(v.Minor, o.Minor); c != 0 {
+		return c
+	}
+	if c := compareUint(v.Patch, o.Patch); c != 0 {
+		return c
+	}
+	return comparePrerelease(v.Prerelease, o.Prerelease)
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// comparePrerelease orders prerelease identifiers per semver 2.0.0: a release
+// sorts above any prerelease, numeric identifiers compare numerically and
+// sort below alphanumeric ones, and a shorter list sorts first on a tie.
+func comparePrerelease(a, b []string) int {
+	switch {
+	case len(a) == 0 && len(b) == 0:
+		return 0
+	case len(a) == 0:
+		return 1
+	case len(b) == 0:
+		return -1
+	}
+	for i := 0; i < len(a) && i < len(b); i++ {
+		na, errA := strconv.ParseUint(a[i], 10, 64)
+		nb, errB := strconv.ParseUint(b[i], 10, 64)
+		switch {
+		case errA == nil && errB == nil:
+			if c := compareUint(na, nb); c != 0 {
+				return c
+			}
+		case errA == nil:
+			return -1
+		case errB == nil:
+			return 1
+		default:
+			if c := strings.Compare(a[i], b[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return compareUint(uint64(len(a)), uint64(len(b)))
+}
+
+func parseRange(s string) (*SemverRange, error) {
+	r := &SemverRange{raw: s}
+	for _, part := range strings.Split(s, "||") {
+		set, err := parseComparatorSet(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range %q: %v", s, err)
+		}
+		r.sets = append(r.sets, set)
+	}
+	return r, nil
+}
+
+func parseComparatorSet(s string) ([]comparator, error) {
+	s = strings.TrimSpace(s)
+	if m := hyphenRangeRe.FindStringSubmatch(s); m != nil {
+		return parseHyphenRange(m[1], m[2])
+	}
+	s = operatorSpaceRe.ReplaceAllString(s, "$1")
+	var set []comparator
+	for _, token := range strings.Fields(s) {
+		comparators, err := parseComparator(token)
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, comparators...)
+	}
+	if len(set) == 0 {
+		set = append(set, comparator{})
+	}
+	return set, nil
+}
+
+func parseHyphenRange(from, to string) ([]comparator, error) {
+	f, err := parsePartialVersion(from)
+	if err != nil {
+		return nil, err
+	}
+	t, err := parsePartialVersion(to)
+	if err != nil {
+		return nil, err
+	}
+	var set []comparator
+	if !isWildcard(f.major) {
+		set = append(set, comparator{">=", f.semver()})
+	}
+	switch {
+	case isWildcard(t.major):
+	case isWildcard(t.minor):
+		set = append(set, comparator{"<", newSemVer(t.number(t.major)+1, 0, 0, "0")})
+	case isWildcard(t.patch):
+		set = append(set, comparator{"<", newSemVer(t.number(t.major), t.number(t.minor)+1, 0, "0")})
+	default:
+		set = append(set, comparator{"<=", t.semver()})
+	}
+	if len(set) == 0 {
+		set = append(set, comparator{})
+	}
+	return set, nil
+}
+
+func parseComparator(token string) ([]comparator, error) {
+	op := ""
+	for _, candidate := range comparatorOps {
+		if strings.HasPrefix(token, candidate) {
+			op = candidate
+			break
+		}
+	}
+	p, err := parsePartialVersion(token[len(op):])
+	if err != nil {
+		return nil, err
+	}
+	switch op {
+	case "~", "~>":
+		return tildeComparators(p), nil
+	case "^":
+		return caretComparators(p), nil
+	}
+	return xRangeComparators(op, p), nil
+}
+
+func tildeComparators(p *partialVersion) []comparator {
+	major, minor := p.number(p.major), p.number(p.minor)
+	switch {
+	case isWildcard(p.major):
+		return []comparator{{}}
+	case isWildcard(p.minor):
+		return []comparator{{">=", newSemVer(major, 0, 0)}, {"<", newSemVer(major+1, 0, 0, "0")}}
+	}
+	return []comparator{{">=", p.semver()}, {"<", newSemVer(major, minor+1, 0, "0")}}
+}
+
+func caretComparators(p *partialVersion) []comparator {
+	major, minor, patch := p.number(p.major), p.number(p.minor), p.number(p.patch)
+	switch {
+	case isWildcard(p.major):
+		return []comparator{{}}
+	case isWildcard(p.minor):
+		return []comparator{{">=", newSemVer(major, 0, 0)}, {"<", newSemVer(major+1, 0, 0, "0")}}
+	case isWildcard(p.patch):
+		if major == 0 {
+			return []comparator{{">=", newSemVer(0, minor, 0)}, {"<", newSemVer(0, minor+1, 0, "0")}}
+		}
+		return []comparator{{">=", newSemVer(major, minor, 0)}, {"<", newSemVer(major+1, 0, 0, "0")}}
+	}
+	lower := comparator{">=", p.semver()}
+	switch {
+	case major > 0:
+		return []comparator{lower, {"<", newSemVer(major+1, 0, 0, "0")}}
+	case minor > 0:
+		return []comparator{lower, {"<", newSemVer(0, minor+1, 0, "0")}}
+	}
+	return []comparator{lower, {"<", newSemVer(0, 0, patch+1, "0")}}
+}
+
+func xRangeComparators(op string, p *partialVersion) []comparator {
+	major, minor := p.number(p.major), p.number(p.minor)
+	if !isWildcard(p.major) && !isWildcard(p.minor) && !isWildcard(p.patch) {
+		if op == "" {
+			op = "="
+		}
+		return []comparator{{op, p.semver()}}
+	}
+	if isWildcard(p.major) {
+		if op == "<" || op == ">" {
+			return []comparator{{"<", newSemVer(0, 0, 0, "0")}}
+		}
+		return []comparator{{}}
+	}
+	switch op {
+	case ">":
+		if isWildcard(p.minor) {
+			return []comparator{{">=", newSemVer(major+1, 0, 0)}}
+		}
+		return []comparator{{">=", newSemVer(major, minor+1, 0)}}
+	case ">=":
+		return []comparator{{">=", newSemVer(major, minor, 0)}}
+	case "<":
+		return []comparator{{"<", newSemVer(major, minor, 0, "0")}}
+	case "<=":
+		if isWildcard(p.minor) {
+			return []comparator{{"<", newSemVer(major+1, 0, 0, "0")}}
+		}
+		return []comparator{{"<", newSemVer(major, minor+1, 0, "0")}}
+	}
+	if isWildcard(p.minor) {
+		return []comparator{{">=", newSemVer(major, 0, 0)}, {"<", newSemVer(major+1, 0, 0, "0")}}
+	}
+	return []comparator{{">=", newSemVer(major, minor, 0)}, {"<", newSemVer(major, minor+1, 0, "0")}}
+}
+
+func (c comparator) test(v *SemVer) bool {
+	if c.version == nil {
+		return true
+	}
+	cmp := v.Compare(c.version)
+	switch c.op {
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	}
+	return cmp == 0
+}
+
+func (r *SemverRange) String() string {
+	return r.raw
+}
+
+func (r *SemverRange) Satisfies(v *SemVer) bool {
+	for _, set := range r.sets {
+		if setSatisfies(set, v) {
+			return true
+		}
+	}
+	return false
+}
+
+// setSatisfies applies node-semver's prerelease rule: a prerelease version
+// only matches a set in which some comparator names a prerelease of the
+// same major.minor.patch tuple.
+func setSatisfies(set []comparator, v *SemVer) bool {
+	for _, c := range set {
+		if !c.test(v) {
+			return false
+		}
+	}
+	if len(v.Prerelease) == 0 {
+		return true
+	}
+	for _, c := range set {
+		if c.version == nil || len(c.version.Prerelease) == 0 {
+			continue
+		}
+		if c.version.Major == v.Major && c.version.Minor == v.Minor && c.version.Patch == v.Patch {
+			return true
+		}
+	}
+	return false
+}
+
+func satisfiesRange(version, constraint string) bool {
+	v, err := parseSemVer(version)
+	if err != nil {
+		return false
+	}
+	r, err := parseRange(constraint)
+	if err != nil {
+		return false
+	}
+	return r.Satisfies(v)
+}
+
+func maxSatisfying(versions []string, r *SemverRange) string {
+	var best *SemVer
+	bestRaw := ""
+	for _, raw := range versions {
+		v, err := parseSemVer(raw)
+		if err != nil || !r.Satisfies(v) {
+			continue
+		}
+		if best == nil || v.Compare(best) > 0 {
+			best, bestRaw = v, raw
+		}
+	}
+	return bestRaw
+}
+
+func compareVersions(v1, v2 string) int {
+	a, errA := parseSemVer(v1)
+	b, errB := parseSemVer(v2)
+	switch {
+	case errA == nil && errB == nil:
+		return a.Compare(b)
+	case errA == nil:
+		return 1
+	case errB == nil:
+		return -1
+	}
+	return strings.Compare(v1, v2)
+}
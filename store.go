@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	STORE_VERSION    = "v1"
+	STORE_INDEX_FILE = ".gopm-index.json"
+)
+
+// StoreIndex is written into every store entry and records the integrity of
+// each extracted file so the entry can be verified without the tarball.
+type StoreIndex struct {
+	Name      string            `json:"name"`
+	Version   string            `json:"version"`
+	Integrity string            `json:"integrity"`
+	Files     map[string]string `json:"files"`
+}
+
+var storeLocks sync.Map
+
+func getStoreDir() (string, error) {
+	if customRoot := os.Getenv("GOPM_ROOT"); customRoot != "" {
+		return filepath.Join(customRoot, "store", STORE_VERSION), nil
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cacheDir, "gopm", "store", STORE_VERSION), nil
+}
+
+// storeEntryDir maps an integrity string to its directory in the store,
+// e.g. sha512/ab/cdef... for the strongest hash the string carries.
+func storeEntryDir(integrity string) (string, error) {
+	verifier, err := newIntegrityVerifier(integrity)
+	if err != nil {
+		return "", err
+	}
+	storeDir, err := getStoreDir()
+	if err != nil {
+		return "", err
+	}
+	digest := hex.EncodeToString(verifier.expected)
+	return filepath.Join(storeDir, verifier.algorithm, digest[:2], digest[2:]), nil
+}
+
+// installFromStore makes sure the package is extracted in the global store
+// and then hardlinks it into packageDir. Packages with install scripts are
+// copied instead, so a script that writes to its own files cannot change the
+// shared store entry. Packages without integrity cannot be addressed and are
+// downloaded straight into place.
+func installFromStore(locked *LockedPackage, packageDir, packageName string) (int64, error) {
+	if locked.Integrity == "" {
+		return downloadAndExtractPackageEnhanced(tarballURL(locked.realName(packageName), locked.Resolved), packageDir, packageName, "")
+	}
+	entryDir, err := storeEntryDir(locked.Integrity)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", packageName, err)
+	}
+	size, err := addToStore(locked, entryDir, packageName)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(filepath.Dir(packageDir), 0755); err != nil {
+		return 0, err
+	}
+	stagingDir, err := os.MkdirTemp(filepath.Dir(packageDir), ".gopm-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(stagingDir)
+	if err := linkTree(entryDir, stagingDir, !hasInstallScripts(entryDir)); err != nil {
+		return 0, err
+	}
+	if err := replacePackageDir(stagingDir, packageDir); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func addToStore(locked *LockedPackage, entryDir, packageName string) (int64, error) {
+	mu, _ := storeLocks.LoadOrStore(entryDir, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	defer mu.(*sync.Mutex).Unlock()
+	if _, err := os.Stat(filepath.Join(entryDir, STORE_INDEX_FILE)); err == nil {
+		return 0, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(entryDir), 0755); err != nil {
+		return 0, err
+	}
+	stagingDir, err := os.MkdirTemp(filepath.Dir(entryDir), ".gopm-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.RemoveAll(stagingDir)
+	size, err := fetchTarball(tarballURL(locked.realName(packageName), locked.Resolved), stagingDir, packageName, locked.Integrity)
+	if err != nil {
+		return 0, err
+	}
+	index, err := indexStoreEntry(stagingDir)
+	if err != nil {
+		return 0, err
+	}
+	index.Name = locked.realName(packageName)
+	index.Version = locked.Version
+	index.Integrity = locked.Integrity
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err := os.WriteFile(filepath.Join(stagingDir, STORE_INDEX_FILE), data, 0644); err != nil {
+		return 0, err
+	}
+	os.RemoveAll(entryDir)
+	if err := os.Rename(stagingDir, entryDir); err != nil {
+		if _, statErr := os.Stat(filepath.Join(entryDir, STORE_INDEX_FILE)); statErr == nil {
+			return size, nil
+		}
+		return 0, err
+	}
+	return size, nil
+}
+
+func indexStoreEntry(dir string) (*StoreIndex, error) {
+	index := &StoreIndex{Files: make(map[string]string)}
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if rel == STORE_INDEX_FILE {
+			return nil
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		index.Files[filepath.ToSlash(rel)] = sum
+		return nil
+	})
+	return index, err
+}
+
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha512.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return "sha512-" + base64.StdEncoding.EncodeToString(h.Sum(nil)), nil
+}
+
+// hasInstallScripts reports whether the package extracted in dir would run
+// any dependency lifecycle script once installed.
+func hasInstallScripts(dir string) bool {
+	pkgJSON, err := readPackageJSONFromPath(filepath.Join(dir, "package.json"))
+	if err != nil {
+		return false
+	}
+	return len(lifecycleScripts(dir, pkgJSON, DEPENDENCY_LIFECYCLE)) > 0
+}
+
+// linkTree recreates src under dest using hardlinks, copying instead when
+// hardlink is false or the two live on different filesystems.
+func linkTree(src, dest string, hardlink bool) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel == STORE_INDEX_FILE {
+			return nil
+		}
+		target := filepath.Join(dest, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+		if hardlink {
+			if err := os.Link(path, target); err == nil {
+				return nil
+			}
+		}
+		return copyFile(path, target)
+	})
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
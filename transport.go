@@ -0,0 +1,150 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	httpClient     *http.Client
+	httpClientErr  error
+	httpClientOnce sync.Once
+)
+
+// getHTTPClient builds the client shared by registry, tarball and search
+// requests from the proxy and TLS settings in .npmrc and the environment.
+func getHTTPClient() (*http.Client, error) {
+	httpClientOnce.Do(func() {
+		httpClient, httpClientErr = newHTTPClient(getConfig())
+	})
+	return httpClient, httpClientErr
+}
+
+func newHTTPClient(c *NpmConfig) (*http.Client, error) {
+	tlsConfig, err := c.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		CheckRedirect: stripAuthOnRedirect,
+		Transport: &http.Transport{
+			Proxy:                 c.proxyFor,
+			DialContext:           (&net.Dialer{Timeout: CONNECT_TIMEOUT, KeepAlive: 30 * time.Second}).DialContext,
+			TLSClientConfig:       tlsConfig,
+			TLSHandshakeTimeout:   CONNECT_TIMEOUT,
+			ResponseHeaderTimeout: HEADER_TIMEOUT,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   10,
+			IdleConnTimeout:       90 * time.Second,
+		},
+	}, nil
+}
+
+// proxyFor picks https-proxy or proxy for the request, falling back to the
+// usual HTTPS_PROXY / HTTP_PROXY variables, unless noproxy matches the host.
+func (c *NpmConfig) proxyFor(req *http.Request) (*url.URL, error) {
+	if c.bypassesProxy(req.URL) {
+		return nil, nil
+	}
+	var candidates []string
+	if req.URL.Scheme == "https" {
+		candidates = append(candidates, c.Get("https-proxy"), c.Get("proxy"), getenvAny("HTTPS_PROXY", "https_proxy"))
+	} else {
+		candidates = append(candidates, c.Get("proxy"))
+	}
+	candidates = append(candidates, getenvAny("HTTP_PROXY", "http_proxy"))
+	for _, proxy := range candidates {
+		if proxy == "" || proxy == "false" || proxy == "null" {
+			continue
+		}
+		if !strings.Contains(proxy, "://") {
+			proxy = "http://" + proxy
+		}
+		proxyURL, err := url.Parse(proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy %q: %v", proxy, err)
+		}
+		return proxyURL, nil
+	}
+	return nil, nil
+}
+
+// bypassesProxy matches u against noproxy / NO_PROXY entries such as
+// "*", "example.com", ".example.com" or "example.com:8080".
+func (c *NpmConfig) bypassesProxy(u *url.URL) bool {
+	noProxy := c.Get("noproxy")
+	if noProxy == "" {
+		noProxy = getenvAny("NO_PROXY", "no_proxy")
+	}
+	host, port := u.Hostname(), u.Port()
+	for _, entry := range strings.FieldsFunc(noProxy, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if entry == "*" {
+			return true
+		}
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			entryHost, entryPort = entry, ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		entryHost = strings.TrimPrefix(strings.ToLower(entryHost), ".")
+		if host == entryHost || strings.HasSuffix(host, "."+entryHost) {
+			return true
+		}
+	}
+	return false
+}
+
+// tlsConfig applies strict-ssl and the certificate settings. Like npm, ca
+// and cafile replace the default roots; NODE_EXTRA_CA_CERTS adds to them.
+func (c *NpmConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: c.Get("strict-ssl") == "false"}
+	var pem []byte
+	if cafile := c.Get("cafile"); cafile != "" {
+		data, err := os.ReadFile(cafile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cafile: %v", err)
+		}
+		pem = append(pem, data...)
+	}
+	if ca := c.Get("ca"); ca != "" && ca != "null" {
+		pem = append(pem, strings.ReplaceAll(ca, `\n`, "\n")...)
+	}
+	if len(pem) > 0 {
+		config.RootCAs = x509.NewCertPool()
+	}
+	if extra := os.Getenv("NODE_EXTRA_CA_CERTS"); extra != "" {
+		data, err := os.ReadFile(extra)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read NODE_EXTRA_CA_CERTS: %v", err)
+		}
+		if config.RootCAs == nil {
+			if config.RootCAs, err = x509.SystemCertPool(); err != nil {
+				config.RootCAs = x509.NewCertPool()
+			}
+		}
+		pem = append(pem, data...)
+	}
+	if config.RootCAs != nil && !config.RootCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no valid certificates found in ca, cafile or NODE_EXTRA_CA_CERTS")
+	}
+	return config, nil
+}
+
+func getenvAny(keys ...string) string {
+	for _, key := range keys {
+		if value := os.Getenv(key); value != "" {
+			return value
+		}
+	}
+	return ""
+}
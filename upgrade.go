@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/term"
+)
+
+// upgradeGroups are the kinds of version bump, in the order the picker
+// lists them.
+var upgradeGroups = []string{"patch", "minor", "major"}
+
+// upgradeChoice is an outdated dependency offered by gopm upgrade -i.
+type upgradeChoice struct {
+	OutdatedPackage
+	from     string
+	bump     string
+	selected bool
+}
+
+// upgradeCommand lets the user pick which outdated dependencies to move to
+// their latest versions, then updates those like gopm update --latest.
+// Without -i it is gopm update.
+func upgradeCommand(names []string) {
+	if !hasFlag("interactive") {
+		updatePackages(names, hasFlag("latest"))
+		return
+	}
+	pkgJSON, err := readPackageJSON()
+	if err != nil {
+		ui.Error(fmt.Sprintf("error reading package.json: %v", err))
+		exitCode = 1
+		return
+	}
+	root := rootPackage(pkgJSON)
+	deps, err := namedDependencies(root, names)
+	if err != nil {
+		ui.Error(err.Error())
+		exitCode = 1
+		return
+	}
+	outdated, errs := findOutdated(root, deps)
+	for _, err := range errs {
+		ui.Error(err.Error())
+	}
+	// failed lookups fail the command, but only once the upgrade has run,
+	// so they cannot change how the install behaves
+	if len(errs) > 0 {
+		defer func() { exitCode = 1 }()
+	}
+	choices := upgradeChoices(outdated)
+	if len(choices) == 0 {
+		if len(errs) == 0 {
+			ui.Success("all dependencies are at their latest versions")
+		}
+		return
+	}
+	var selected []string
+	if term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd())) {
+		selected, err = pickUpgradesTTY(choices)
+	} else {
+		selected, err = pickUpgradesPrompt(choices, os.Stdin)
+	}
+	if err != nil {
+		ui.Error(err.Error())
+		exitCode = 1
+		return
+	}
+	if len(selected) == 0 {
+		ui.Info("nothing selected, no packages upgraded")
+		return
+	}
+	updatePackages(selected, true)
+}
+
+// upgradeChoices keeps the outdated packages whose latest version is newer
+// than the installed one, or the wanted one when nothing is installed, and
+// sorts them by bump and name.
+func upgradeChoices(outdated []OutdatedPackage) []upgradeChoice {
+	var choices []upgradeChoice
+	for _, pkg := range outdated {
+		from := pkg.Current
+		if from == "" {
+			from = pkg.Wanted
+		}
+		bump := versionBump(from, pkg.Latest)
+		if bump == "" {
+			continue
+		}
+		choices = append(choices, upgradeChoice{OutdatedPackage: pkg, from: from, bump: bump})
+	}
+	rank := func(bump string) int {
+		for i, group := range upgradeGroups {
+			if group == bump {
+				return i
+			}
+		}
+		return len(upgradeGroups)
+	}
+	sort.SliceStable(choices, func(i, j int) bool {
+		if choices[i].bump != choices[j].bump {
+			return rank(choices[i].bump) < rank(choices[j].bump)
+		}
+		return choices[i].Name < choices[j].Name
+	})
+	return choices
+}
+
+// versionBump is "patch", "minor" or "major" for an upgrade from one version
+// to another, or empty when to is not newer. Below 1.0.0 a minor bump can
+// break like a major one, so it is reported as one.
+func versionBump(from, to string) string {
+	a, err := parseSemVer(from)
+	if err != nil {
+		return ""
+	}
+	b, err := parseSemVer(to)
+	if err != nil || b.Compare(a) <= 0 {
+		return ""
+	}
+	switch {
+	case a.Major != b.Major, a.Major == 0 && a.Minor != b.Minor:
+		return "major"
+	case a.Minor != b.Minor:
+		return "minor"
+	default:
+		return "patch"
+	}
+}
+
+// changelogURL turns a repository field into a browsable link: the releases
+// page for GitHub, or the repository itself elsewhere.
+func changelogURL(repository string) string {
+	url := strings.TrimSuffix(strings.TrimPrefix(repository, "git+"), ".git")
+	switch {
+	case url == "":
+		return ""
+	case strings.HasPrefix(url, "github:"):
+		url = "https://github.com/" + strings.TrimPrefix(url, "github:")
+	case strings.HasPrefix(url, "gitlab:"):
+		url = "https://gitlab.com/" + strings.TrimPrefix(url, "gitlab:")
+	case strings.HasPrefix(url, "bitbucket:"):
+		url = "https://bitbucket.org/" + strings.TrimPrefix(url, "bitbucket:")
+	case strings.HasPrefix(url, "git@github.com:"):
+		url = "https://github.com/" + strings.TrimPrefix(url, "git@github.com:")
+	case strings.HasPrefix(url, "ssh://git@"):
+		url = "https://" + strings.TrimPrefix(url, "ssh://git@")
+	case strings.HasPrefix(url, "git://"):
+		url = "https://" + strings.TrimPrefix(url, "git://")
+	case !strings.Contains(url, ":") && strings.Count(url, "/") == 1:
+		url = "https://github.com/" + url
+	}
+	if strings.HasPrefix(url, "https://github.com/") {
+		return url + "/releases"
+	}
+	return url
+}
+
+// renderUpgrades lays the choices out by group. With a cursor each row gets
+// a checkbox and the row under the cursor is marked; with a negative cursor
+// rows are numbered for the plain prompt.
+func renderUpgrades(choices []upgradeChoice, cursor int) []string {
+	nameWidth, fromWidth, toWidth := 0, 0, 0
+	for _, choice := range choices {
+		nameWidth = max(nameWidth, len(choice.Name))
+		fromWidth = max(fromWidth, len(choice.from))
+		toWidth = max(toWidth, len(choice.Latest))
+	}
+	colors := map[string]func(a ...interface{}) string{
+		"patch": ui.green.Sprint,
+		"minor": ui.yellow.Sprint,
+		"major": ui.red.Sprint,
+	}
+	var lines []string
+	group := ""
+	for i, choice := range choices {
+		if choice.bump != group {
+			group = choice.bump
+			lines = append(lines, "", colors[group](ui.bold.Sprint(group)))
+		}
+		var mark string
+		switch {
+		case cursor < 0:
+			mark = fmt.Sprintf("%3d)", i+1)
+		case choice.selected:
+			mark = "  " + ui.green.Sprint("◉")
+		default:
+			mark = "  ◯"
+		}
+		if i == cursor {
+			mark = ui.cyan.Sprint("❯") + mark[1:]
+		}
+		row := fmt.Sprintf("%s %-*s  %*s → %s",
+			mark, nameWidth, choice.Name, fromWidth, choice.from,
+			colors[group](fmt.Sprintf("%-*s", toWidth, choice.Latest)))
+		if link := changelogURL(choice.Repository); link != "" {
+			row += "  " + ui.blue.Sprint(link)
+		}
+		lines = append(lines, row)
+	}
+	return lines
+}
+
+// pickUpgradesTTY runs the picker in raw mode: arrows or j/k move, space
+// toggles, a toggles everything, enter confirms and q or esc cancels.
+func pickUpgradesTTY(choices []upgradeChoice) ([]string, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return pickUpgradesPrompt(choices, os.Stdin)
+	}
+	defer term.Restore(fd, state)
+	help := ui.bold.Sprint("choose packages to upgrade") + "  (↑/↓ move, space toggle, a all, enter upgrade, q quit)"
+	reader := bufio.NewReader(os.Stdin)
+	cursor, drawn := 0, 0
+	for {
+		if drawn > 0 {
+			fmt.Printf("\033[%dA\r\033[J", drawn)
+		}
+		lines := append([]string{help}, renderUpgrades(choices, cursor)...)
+		fmt.Print(strings.Join(lines, "\r\n") + "\r\n")
+		drawn = len(lines)
+		key, err := readKey(reader)
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "up", "k":
+			cursor = (cursor + len(choices) - 1) % len(choices)
+		case "down", "j":
+			cursor = (cursor + 1) % len(choices)
+		case " ":
+			choices[cursor].selected = !choices[cursor].selected
+		case "a":
+			all := true
+			for _, choice := range choices {
+				all = all && choice.selected
+			}
+			for i := range choices {
+				choices[i].selected = !all
+			}
+		case "enter":
+			return selectedUpgrades(choices), nil
+		case "q", "esc", "ctrl-c":
+			return nil, nil
+		}
+	}
+}
+
+// readKey reads one keypress from a terminal in raw mode.
+func readKey(reader *bufio.Reader) (string, error) {
+	b, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	switch b {
+	case '\r', '\n':
+		return "enter", nil
+	case 3:
+		return "ctrl-c", nil
+	case 0x1b:
+		if reader.Buffered() == 0 {
+			return "esc", nil
+		}
+		seq := make([]byte, 2)
+		if _, err := io.ReadFull(reader, seq); err != nil {
+			return "", err
+		}
+		switch string(seq) {
+		case "[A":
+			return "up", nil
+		case "[B":
+			return "down", nil
+		}
+		return "", nil
+	}
+	return string(b), nil
+}
+
+// pickUpgradesPrompt is the picker without a terminal: it prints the
+// numbered choices and reads one line naming the ones to upgrade.
+func pickUpgradesPrompt(choices []upgradeChoice, in io.Reader) ([]string, error) {
+	for _, line := range renderUpgrades(choices, -1) {
+		fmt.Println(line)
+	}
+	fmt.Print("\npackages to upgrade (numbers or names, \"all\", or empty for none): ")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	fmt.Println()
+	fields := strings.FieldsFunc(line, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for _, field := range fields {
+		if field == "all" {
+			for i := range choices {
+				choices[i].selected = true
+			}
+			continue
+		}
+		if n, err := strconv.Atoi(field); err == nil {
+			if n < 1 || n > len(choices) {
+				return nil, fmt.Errorf("no package numbered %d", n)
+			}
+			choices[n-1].selected = true
+			continue
+		}
+		found := false
+		for i := range choices {
+			if choices[i].Name == field {
+				choices[i].selected = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s is not an outdated dependency", field)
+		}
+	}
+	return selectedUpgrades(choices), nil
+}
+
+func selectedUpgrades(choices []upgradeChoice) []string {
+	var names []string
+	for _, choice := range choices {
+		if choice.selected {
+			names = append(names, choice.Name)
+		}
+	}
+	return names
+}
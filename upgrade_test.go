@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestVersionBump(t *testing.T) {
+	tests := []struct {
+		from, to string
+		want     string
+	}{
+		{"1.2.3", "1.2.4", "patch"},
+		{"1.2.3", "1.3.0", "minor"},
+		{"1.2.3", "2.0.0", "major"},
+		{"0.2.3", "0.2.4", "patch"},
+		{"0.2.3", "0.3.0", "major"},
+		{"0.0.1", "0.0.2", "patch"},
+		{"1.2.3-beta.1", "1.2.3", "patch"},
+		{"1.2.3", "1.2.3", ""},
+		{"1.3.0", "1.2.9", ""},
+		{"not-a-version", "1.0.0", ""},
+		{"1.0.0", "latest", ""},
+	}
+	for _, tt := range tests {
+		if got := versionBump(tt.from, tt.to); got != tt.want {
+			t.Errorf("versionBump(%q, %q) = %q, want %q", tt.from, tt.to, got, tt.want)
+		}
+	}
+}
+
+func TestChangelogURL(t *testing.T) {
+	tests := []struct {
+		repository string
+		want       string
+	}{
+		{"", ""},
+		{"https://github.com/user/repo", "https://github.com/user/repo/releases"},
+		{"git+https://github.com/user/repo.git", "https://github.com/user/repo/releases"},
+		{"git://github.com/user/repo.git", "https://github.com/user/repo/releases"},
+		{"git@github.com:user/repo.git", "https://github.com/user/repo/releases"},
+		{"ssh://git@github.com/user/repo.git", "https://github.com/user/repo/releases"},
+		{"github:user/repo", "https://github.com/user/repo/releases"},
+		{"user/repo", "https://github.com/user/repo/releases"},
+		{"gitlab:user/repo", "https://gitlab.com/user/repo"},
+		{"bitbucket:user/repo", "https://bitbucket.org/user/repo"},
+		{"git+https://gitlab.com/user/repo.git", "https://gitlab.com/user/repo"},
+	}
+	for _, tt := range tests {
+		if got := changelogURL(tt.repository); got != tt.want {
+			t.Errorf("changelogURL(%q) = %q, want %q", tt.repository, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Workspaces is the package.json "workspaces" field, either a list of glob
+// patterns or yarn's {"packages": [...]} form.
+type Workspaces []string
+
+func (w *Workspaces) UnmarshalJSON(data []byte) error {
+	var patterns []string
+	if err := json.Unmarshal(data, &patterns); err == nil {
+		*w = patterns
+		return nil
+	}
+	var obj struct {
+		Packages []string `json:"packages"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	*w = obj.Packages
+	return nil
+}
+
+// Workspace is a package of a monorepo, linked into the root node_modules
+// rather than fetched from the registry.
+type Workspace struct {
+	Name    string
+	Dir     string
+	PkgJSON *PackageJSON
+}
+
+// findWorkspaces expands the workspace patterns of the package.json in
+// rootDir into the packages they match, sorted by name.
+func findWorkspaces(rootDir string, pkgJSON *PackageJSON) ([]Workspace, error) {
+	var workspaces []Workspace
+	seen := make(map[string]string)
+	for _, pattern := range pkgJSON.Workspaces {
+		matches, err := filepath.Glob(filepath.Join(rootDir, filepath.FromSlash(pattern)))
+		if err != nil {
+			return nil, fmt.Errorf("invalid workspace pattern %q: %v", pattern, err)
+		}
+		for _, match := range matches {
+			wsJSON, err := readPackageJSONFromPath(filepath.Join(match, "package.json"))
+			if err != nil {
+				continue
+			}
+			rel, err := filepath.Rel(rootDir, match)
+			if err != nil {
+				return nil, err
+			}
+			rel = filepath.ToSlash(rel)
+			if wsJSON.Name == "" {
+				return nil, fmt.Errorf("workspace %s has no name in its package.json", rel)
+			}
+			if other, ok := seen[wsJSON.Name]; ok {
+				if other == rel {
+					continue
+				}
+				return nil, fmt.Errorf("workspaces %s and %s are both named %s", other, rel, wsJSON.Name)
+			}
+			seen[wsJSON.Name] = rel
+			workspaces = append(workspaces, Workspace{Name: wsJSON.Name, Dir: rel, PkgJSON: wsJSON})
+		}
+	}
+	sort.Slice(workspaces, func(i, j int) bool {
+		return workspaces[i].Name < workspaces[j].Name
+	})
+	return workspaces, nil
+}
+
+// lockedLink is the lockfile entry for a workspace: a link to its directory
+// carrying its dependencies, dev ones included, so they resolve from there.
+func (w Workspace) lockedLink() *LockedPackage {
+	return &LockedPackage{
+		Version:              w.PkgJSON.Version,
+		Resolved:             w.Dir,
+		Link:                 true,
+		Dependencies:         w.PkgJSON.Dependencies,
+		DevDependencies:      w.PkgJSON.DevDependencies,
+		PeerDependencies:     w.PkgJSON.PeerDependencies,
+		PeerDependenciesMeta: w.PkgJSON.PeerDependenciesMeta,
+	}
+}
+
+// linkWorkspace points node_modules/<name> at the workspace directory with a
+// relative symlink, replacing whatever was installed there before.
+func linkWorkspace(baseDir, path, target string) error {
+	linkPath := filepath.Join(baseDir, filepath.FromSlash(path))
+	targetPath := filepath.Join(baseDir, filepath.FromSlash(target))
+	rel, err := filepath.Rel(filepath.Dir(linkPath), targetPath)
+	if err != nil {
+		return err
+	}
+	if existing, err := os.Readlink(linkPath); err == nil && existing == rel {
+		return nil
+	}
+	if err := os.RemoveAll(linkPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(linkPath), 0755); err != nil {
+		return err
+	}
+	return os.Symlink(rel, linkPath)
+}
+
+// selectWorkspaces returns the workspaces named by --workspace (by package
+// name or directory) or all of them for --workspaces.
+func selectWorkspaces() ([]Workspace, error) {
+	pkgJSON, err := readPackageJSON()
+	if err != nil {
+		return nil, err
+	}
+	workspaces, err := findWorkspaces(".", pkgJSON)
+	if err != nil {
+		return nil, err
+	}
+	if hasFlag("workspaces") {
+		return workspaces, nil
+	}
+	var selected []Workspace
+	for _, want := range flagValues("workspace") {
+		found := false
+		for _, ws := range workspaces {
+			if ws.Name == want || ws.Dir == filepath.ToSlash(filepath.Clean(want)) {
+				selected = append(selected, ws)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("no workspace matches %s", want)
+		}
+	}
+	return selected, nil
+}
+
+func workspacesRequested() bool {
+	return hasFlag("workspaces") || len(flagValues("workspace")) > 0
+}
+
+// runWorkspaceScripts runs a script in each selected workspace. With
+// --workspaces, workspaces that lack the script are skipped.
+func runWorkspaceScripts(args []string) {
+	workspaces, err := selectWorkspaces()
+	if err != nil {
+		ui.Error(err.Error())
+		exitCode = 1
+		return
+	}
+	if len(workspaces) == 0 {
+		ui.Warning("no workspaces found in package.json")
+		return
+	}
+	for _, ws := range workspaces {
+		if len(args) == 0 {
+			listScripts(ws.PkgJSON)
+			continue
+		}
+		name := args[0]
+		if _, ok := ws.PkgJSON.Scripts[name]; !ok && hasFlag("workspaces") {
+			ui.Info(fmt.Sprintf("%s has no %s script, skipping", ws.Name, name))
+			continue
+		}
+		ui.Header(fmt.Sprintf("%s (%s)", ws.Name, ws.Dir))
+		if code := runScript(ws.Dir, ws.PkgJSON, name, scriptArgs(args[1:])); code != 0 {
+			exitCode = code
+		}
+	}
+}
+
+// workspaceMismatches describes how the workspaces found on disk differ from
+// the ones the lockfile links.
+func (l *Lockfile) workspaceMismatches(workspaces []Workspace) []string {
+	var problems []string
+	linked := make(map[string]*LockedPackage)
+	for path, entry := range l.Packages {
+		if entry.Link {
+			_, name := splitLockPath(path)
+			linked[name] = entry
+		}
+	}
+	for _, ws := range workspaces {
+		entry, ok := linked[ws.Name]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("workspace %s is missing from %s", ws.Name, LOCKFILE_NAME))
+		case !sameDependencies(entry.Dependencies, ws.PkgJSON.Dependencies) ||
+			!sameDependencies(entry.DevDependencies, ws.PkgJSON.DevDependencies) ||
+			!sameDependencies(entry.PeerDependencies, ws.PkgJSON.PeerDependencies):
+			problems = append(problems, fmt.Sprintf("workspace %s has different dependencies in %s", ws.Name, LOCKFILE_NAME))
+		}
+		delete(linked, ws.Name)
+	}
+	for name := range linked {
+		problems = append(problems, fmt.Sprintf("workspace %s is in %s but not in package.json", name, LOCKFILE_NAME))
+	}
+	return problems
+}
+
+func sameDependencies(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, spec := range a {
+		if other, ok := b[name]; !ok || other != spec {
+			return false
+		}
+	}
+	return true
+}